@@ -1,12 +1,14 @@
 package main
 
 import (
-	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/compress"
+	"httpfromtcp/internal/proxy"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -47,9 +49,48 @@ func body200() []byte {
 </html>`)
 }
 
+// serves HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are set, send SIGHUP
+// to pick up renewed certificates
+func tlsOptions() *server.TLSOptions {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil
+	}
+	opts := &server.TLSOptions{
+		Certificates: []server.CertificateFiles{{CertFile: certFile, KeyFile: keyFile}},
+	}
+	// TLS_CLIENT_CA_FILE turns on mutual TLS
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		opts.ClientAuth = server.ClientAuthRequired
+		opts.ClientCAFile = caFile
+	}
+	return opts
+}
+
 func main() {
-	server, err := server.Serve(port, func(w *response.Writer, req *request.Request) {
+	// /httpbin/... is forwarded to httpbin.org, e.g. /httpbin/stream/10,
+	// over kept-alive connections
+	httpbin := proxy.HandlerWithOptions(&url.URL{Scheme: "https", Host: "httpbin.org"}, proxy.Options{
+		Client: &client.Client{
+			MaxIdlePerHost:  8,
+			MaxConnsPerHost: 32,
+		},
+		Timeout:     proxy.DefaultTimeout,
+		StripPrefix: "/httpbin",
+	})
+
+	server, err := server.ServeWithOptions(port, compress.Handler(func(w *response.Writer, req *request.Request) {
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
+			httpbin(w, req)
+			return
+		}
+
+		// lets reloads of the static pages come back as 304
+		w.SetAutoETag(req)
+
 		h := response.GetDefaultHeaders(0)
+		// the server's buffered writer computes it for us
+		h.Delete("Content-Length")
 		body := body200()
 		status := response.StatusOK
 
@@ -59,43 +100,12 @@ func main() {
 		} else if req.RequestLine.RequestTarget == "/myproblem" {
 			body = body500()
 			status = response.StatusInternalServerError
-		} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/stream") {
-			target := req.RequestLine.RequestTarget
-			res, err := http.Get("https://httpbin.org/" + target[len("/httpbin/"):])
-			if err != nil {
-				body = body500()
-				status = response.StatusInternalServerError
-			} else {
-				w.WriteStatusLine(response.StatusOK)
-
-				h.Delete("Content-length")
-				h.Set("transfer-encoding", "chunked")
-				h.Set("content-type", "text/plain")
-				w.WriteHeaders(*h)
-
-				buf := make([]byte, 32)
-				for {
-					n, err := res.Body.Read(buf)
-					if n > 0 {
-						// w.WriteBody([]byte(fmt.Sprintf("%x\r\n", n)))
-						// w.WriteBody(buf[:n])
-						// w.WriteBody([]byte("\r\n"))
-						w.WriteChunkedBody(buf[:n])
-					}
-					if err != nil {
-						break
-					}
-				}
-				w.WriteChunkedBodyDone()
-				return
-			}
 		}
-		h.Set("Content-Length", fmt.Sprintf("%d", len(body)))
 		h.Set("Content-Type", "text/html")
 		w.WriteStatusLine(status)
 		w.WriteHeaders(*h)
 		w.WriteBody(body)
-	})
+	}), server.Options{ServerName: "httpfromtcp", TLS: tlsOptions()})
 
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
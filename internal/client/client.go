@@ -0,0 +1,288 @@
+// Package client is an HTTP/1.1 client that talks to the network itself,
+// with the same request and headers types the server uses
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ERROR_UNSUPPORTED_SCHEME = fmt.Errorf("client: unsupported url scheme")
+
+// DefaultDialTimeout bounds connecting when DialTimeout is not set
+const DefaultDialTimeout = 30 * time.Second
+
+type Client struct {
+	// Timeout bounds a whole exchange, from dialing to the end of the
+	// body. Zero leaves it to the context.
+	Timeout time.Duration
+	// DialTimeout bounds connecting, DefaultDialTimeout if zero
+	DialTimeout time.Duration
+	// TLSConfig is used for https URLs, nil means the defaults
+	TLSConfig *tls.Config
+
+	// MaxIdlePerHost caps the kept-alive connections per host,
+	// DefaultMaxIdlePerHost if zero. Negative turns keep-alive off.
+	MaxIdlePerHost int
+	// IdleTimeout closes kept-alive connections unused for that long,
+	// DefaultIdleTimeout if zero
+	IdleTimeout time.Duration
+	// MaxConnsPerHost caps the connections per host, in use or idle.
+	// Requests over it wait for a connection to come free. Zero means no
+	// limit.
+	MaxConnsPerHost int
+
+	mu    sync.Mutex
+	pools map[string]*hostPool
+	stats Stats
+}
+
+var DefaultClient = &Client{}
+
+// Response is a parsed response, its Body holds the connection
+type Response struct {
+	*response.Response
+	// Body has to be closed when done with it
+	Body io.ReadCloser
+}
+
+// Get fetches rawURL with DefaultClient
+func Get(ctx context.Context, rawURL string) (*Response, error) {
+	return DefaultClient.Get(ctx, rawURL)
+}
+
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	return c.Do(ctx, "GET", rawURL, nil, nil)
+}
+
+// Do sends one request and returns once the response headers are in.
+// Connections are kept alive and reused per host. The body streams from
+// the connection, which goes back to the pool once the body was read to
+// the end or closed. Cancelling ctx aborts the exchange, the body
+// included.
+func (c *Client) Do(ctx context.Context, method, rawURL string, h *headers.Headers, body []byte) (*Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %q", ERROR_UNSUPPORTED_SCHEME, u.Scheme)
+	}
+	req := newRequest(method, u, h, body, c.maxIdlePerHost() < 0)
+
+	cancel := func() {}
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+	for {
+		pc, err := c.getConn(ctx, address(u), func() (net.Conn, error) {
+			return c.dial(ctx, u)
+		})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		res, err := c.exchange(ctx, pc, req, cancel)
+		// the server may close an idle connection just as it is reused,
+		// requests that are safe to repeat get another try on a new one
+		if err != nil && pc.reused && ctx.Err() == nil && idempotent(method) && isConnectionLost(err) {
+			continue
+		}
+		if err != nil {
+			cancel()
+		}
+		return res, err
+	}
+}
+
+// exchange writes req on pc and reads the response head. The connection
+// goes back to the pool or is closed once the body has been read.
+func (c *Client) exchange(ctx context.Context, pc *persistConn, req *request.Request, cancel func()) (*Response, error) {
+	conn := pc.conn
+	// a past deadline unblocks whatever is reading or writing conn
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	release := func(reusable bool) {
+		// after the deadline trick the connection is no good
+		interrupted := !stop()
+		cancel()
+		if reusable && !interrupted {
+			c.putConn(pc)
+		} else {
+			c.closeConn(pc)
+		}
+	}
+
+	bw := bufio.NewWriter(conn)
+	err := req.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		stop()
+		c.closeConn(pc)
+		return nil, contextError(ctx, err)
+	}
+
+	parsed, err := response.ResponseFromReader(conn, req.RequestLine.Method)
+	if err != nil {
+		stop()
+		c.closeConn(pc)
+		return nil, contextError(ctx, err)
+	}
+	closeRequested := req.Headers != nil && hasClose(req.Headers)
+	res := &Response{Response: parsed}
+	res.Body = &responseBody{ctx: ctx, res: parsed, release: func() {
+		release(!closeRequested && parsed.KeepAlive())
+	}}
+	if parsed.Done() {
+		// nothing to read, e.g. HEAD or 204: the connection is free now
+		res.Body.(*responseBody).finish()
+	}
+	return res, nil
+}
+
+// address is host:port of u, with the scheme's default port
+func address(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// isConnectionLost tells a connection the server already closed from
+// other failures
+func isConnectionLost(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func hasClose(h *headers.Headers) bool {
+	connection, _ := h.Get("connection")
+	for _, option := range strings.Split(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if u.Scheme == "http" {
+		return dialer.DialContext(ctx, "tcp", address(u))
+	}
+
+	config := c.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = u.Hostname()
+	}
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: config}
+	return tlsDialer.DialContext(ctx, "tcp", address(u))
+}
+
+// newRequest builds the outgoing request, Host and framing filled in
+func newRequest(method string, u *url.URL, h *headers.Headers, body []byte, closeConn bool) *request.Request {
+	if h == nil {
+		h = headers.NewHeaders()
+	} else {
+		h = h.Clone()
+	}
+	if _, ok := h.Get("host"); !ok {
+		h.Set("Host", u.Host)
+	}
+	// the body is sent whole, Request.Write frames it with Content-Length.
+	// Methods that expect a body say so even when it is empty.
+	h.Delete("transfer-encoding")
+	h.Delete("content-length")
+	if method == "POST" || method == "PUT" || method == "PATCH" {
+		h.Set("Content-Length", "0")
+	}
+	if closeConn {
+		h.Set("Connection", "close")
+	}
+	return request.NewRequest(method, u.RequestURI(), "1.1", h, body)
+}
+
+// contextError reports why an exchange was cut short: the context's
+// error if it ended, err otherwise
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	return err
+}
+
+// responseBody releases the connection once the body was read to the end
+// or closed
+type responseBody struct {
+	ctx      context.Context
+	res      *response.Response
+	release  func()
+	released bool
+	eof      bool
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	if b.eof {
+		return 0, io.EOF
+	}
+	if b.released {
+		return 0, fmt.Errorf("client: read on closed body")
+	}
+	n, err := b.res.Body.Read(p)
+	if err == io.EOF {
+		b.finish()
+	} else if err != nil {
+		err = contextError(b.ctx, err)
+	}
+	return n, err
+}
+
+// finish marks the body as read to the end and lets the connection go
+func (b *responseBody) finish() {
+	b.eof = true
+	b.Close()
+}
+
+func (b *responseBody) Close() error {
+	if !b.released {
+		b.released = true
+		b.release()
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve starts one of our servers and returns its base URL
+func serve(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+// serveRaw answers every connection with a canned response after reading
+// the request head
+func serveRaw(t *testing.T, raw string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReader(conn)
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			io.WriteString(conn, raw)
+			conn.Close()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+// serveKeepAlive answers any number of requests per connection with "ok".
+// Requests for /slow wait for release to be closed.
+func serveKeepAlive(t *testing.T, release <-chan struct{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					requestLine, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if line == "\r\n" {
+							break
+						}
+					}
+					if strings.Contains(requestLine, " /slow ") {
+						<-release
+					}
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func readAll(t *testing.T, res *Response) string {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestClient(t *testing.T) {
+	url := serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("content-length")
+		h.Set("X-Method", req.RequestLine.Method)
+		h.Set("X-Target", req.RequestLine.RequestTarget)
+		custom, _ := req.Headers.Get("x-custom")
+		h.Set("X-Custom", custom)
+		switch req.Path() {
+		case "/chunked":
+			h.Set("Trailer", "X-Checksum")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(*h)
+			w.WriteChunkedBody([]byte("hello "))
+			w.WriteChunkedBody([]byte("chunks"))
+			trailers := headers.NewHeaders()
+			trailers.Set("X-Checksum", "abc")
+			w.WriteTrailers(*trailers)
+		case "/empty":
+			w.WriteStatusLine(response.StatusNoContent)
+			w.WriteHeaders(*h)
+		default:
+			w.WriteStatusLine(response.StatusCreated)
+			w.WriteHeaders(*h)
+			w.WriteBody(append([]byte("got: "), req.Body...))
+		}
+	})
+	ctx := context.Background()
+
+	// Test: method, target, headers and body go out, status and body come back
+	h := headers.NewHeaders()
+	h.Set("X-Custom", "value")
+	res, err := DefaultClient.Do(ctx, "POST", url+"/items?id=7", h, []byte("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCreated, res.StatusLine.StatusCode)
+	assert.Equal(t, "Created", res.StatusLine.ReasonPhrase)
+	assert.Equal(t, "1.1", res.StatusLine.HttpVersion)
+	method, _ := res.Headers.Get("x-method")
+	target, _ := res.Headers.Get("x-target")
+	custom, _ := res.Headers.Get("x-custom")
+	assert.Equal(t, "POST /items?id=7 value", method+" "+target+" "+custom)
+	assert.Equal(t, "got: payload", readAll(t, res))
+
+	// Test: chunked body with trailers
+	res, err = Get(ctx, url+"/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, "hello chunks", readAll(t, res))
+	checksum, _ := res.Trailers.Get("x-checksum")
+	assert.Equal(t, "abc", checksum)
+
+	// Test: HEAD and 204 have no body even with a Content-Length
+	res, err = DefaultClient.Do(ctx, "HEAD", url+"/", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", readAll(t, res))
+	res, err = Get(ctx, url+"/empty")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusNoContent, res.StatusLine.StatusCode)
+	assert.Equal(t, "", readAll(t, res))
+}
+
+func TestClientFraming(t *testing.T) {
+	ctx := context.Background()
+
+	// Test: interim responses are skipped, the body runs to the close
+	res, err := Get(ctx, serveRaw(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nX-A: 1\r\n\r\nuntil close"))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, res.StatusLine.StatusCode)
+	assert.Equal(t, "until close", readAll(t, res))
+
+	// Test: an empty reason phrase is fine
+	res, err = Get(ctx, serveRaw(t, "HTTP/1.1 299 \r\nContent-Length: 2\r\n\r\nok"))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCode(299), res.StatusLine.StatusCode)
+	assert.Equal(t, "", res.StatusLine.ReasonPhrase)
+	assert.Equal(t, "ok", readAll(t, res))
+
+	// Test: a body shorter than its Content-Length is an error
+	res, err = Get(ctx, serveRaw(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	res.Body.Close()
+
+	// Test: broken status lines and chunks
+	for _, c := range []struct {
+		raw string
+		err error
+	}{
+		{"HTTP/2 200 OK\r\n\r\n", response.ERROR_MALFORMED_STATUS_LINE},
+		{"HTTP/1.1 20 OK\r\n\r\n", response.ERROR_MALFORMED_STATUS_LINE},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", response.ERROR_MALFORMED_CHUNK},
+	} {
+		res, err := Get(ctx, serveRaw(t, c.raw))
+		if err == nil {
+			_, err = io.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		assert.ErrorIs(t, err, c.err, c.raw)
+	}
+
+	// Test: only http and https
+	_, err = Get(ctx, "ftp://localhost/")
+	assert.ErrorIs(t, err, ERROR_UNSUPPORTED_SCHEME)
+}
+
+func TestClientTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	url := serve(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(0))
+		if req.Path() == "/slow-body" {
+			w.WriteChunkedBody([]byte("start"))
+			w.Flush()
+		}
+		<-release
+	})
+
+	// Test: the client's Timeout covers waiting for the response
+	c := &Client{Timeout: 50 * time.Millisecond}
+	_, err := c.Get(context.Background(), url+"/slow")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Test: cancelling the context stops a body that is still streaming
+	ctx, cancel := context.WithCancel(context.Background())
+	res, err := Get(ctx, url+"/slow-body")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	start := make([]byte, len("start"))
+	_, err = io.ReadFull(res.Body, start)
+	require.NoError(t, err)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientPool(t *testing.T) {
+	url := serveKeepAlive(t, nil)
+	ctx := context.Background()
+
+	// Test: a connection read to the end is reused for the next request
+	c := &Client{}
+	for range 3 {
+		res, err := c.Get(ctx, url+"/")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", readAll(t, res))
+	}
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, 1, stats.Open)
+	assert.Equal(t, 1, stats.Idle)
+
+	// Test: a body closed early takes its connection with it
+	res, err := c.Get(ctx, url+"/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 0, c.Stats().Open)
+
+	// Test: idle connections are closed after IdleTimeout
+	c = &Client{IdleTimeout: 20 * time.Millisecond}
+	res, err = c.Get(ctx, url+"/")
+	require.NoError(t, err)
+	readAll(t, res)
+	assert.Equal(t, 1, c.Stats().Idle)
+	assert.Eventually(t, func() bool { return c.Stats().Open == 0 }, time.Second, 5*time.Millisecond)
+
+	// Test: without keep-alive every request dials
+	c = &Client{MaxIdlePerHost: -1}
+	for range 2 {
+		res, err := c.Get(ctx, url+"/")
+		require.NoError(t, err)
+		readAll(t, res)
+	}
+	assert.Equal(t, uint64(2), c.Stats().Misses)
+	assert.Equal(t, 0, c.Stats().Open)
+
+	// Test: CloseIdleConnections empties the pool
+	c = &Client{}
+	res, err = c.Get(ctx, url+"/")
+	require.NoError(t, err)
+	readAll(t, res)
+	c.CloseIdleConnections()
+	assert.Equal(t, Stats{Misses: 1}, c.Stats())
+}
+
+func TestClientPoolHealthCheck(t *testing.T) {
+	// serveRaw answers one request per connection, then hangs up without
+	// a Connection: close
+	url := serveRaw(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	ctx := context.Background()
+
+	// Test: a connection the server closed while idle is not reused
+	c := &Client{}
+	res, err := c.Get(ctx, url)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readAll(t, res))
+	time.Sleep(20 * time.Millisecond)
+	res, err = c.Get(ctx, url)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readAll(t, res))
+	assert.Equal(t, uint64(2), c.Stats().Misses)
+	assert.Equal(t, uint64(0), c.Stats().Hits)
+}
+
+func TestClientMaxConnsPerHost(t *testing.T) {
+	release := make(chan struct{})
+	url := serveKeepAlive(t, release)
+	ctx := context.Background()
+	c := &Client{MaxConnsPerHost: 1}
+	get := func(url string, result chan<- string) {
+		res, err := c.Get(ctx, url)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		result <- string(body)
+	}
+
+	// Test: a request over the limit waits for the connection in use
+	slow := make(chan string)
+	go get(url+"/slow", slow)
+	require.Eventually(t, func() bool { return c.Stats().Open == 1 }, time.Second, 5*time.Millisecond)
+	waited := make(chan string)
+	go get(url+"/", waited)
+	require.Eventually(t, func() bool { return c.Stats().Waits == 1 }, time.Second, 5*time.Millisecond)
+	close(release)
+	assert.Equal(t, "ok", <-slow)
+	assert.Equal(t, "ok", <-waited)
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, 1, stats.Open)
+
+	// Test: giving up on the wait is a context error
+	res, err := c.Get(ctx, url+"/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = c.Get(short, url+"/")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// DefaultMaxIdlePerHost is how many kept-alive connections wait for the
+// next request to a host when MaxIdlePerHost is not set
+const DefaultMaxIdlePerHost = 4
+
+// DefaultIdleTimeout closes kept-alive connections nobody used for this
+// long when IdleTimeout is not set
+const DefaultIdleTimeout = 90 * time.Second
+
+// Stats counts how requests got their connection
+type Stats struct {
+	// Hits reused an idle connection, Misses dialed a new one
+	Hits   uint64
+	Misses uint64
+	// Waits had to queue for a connection because of MaxConnsPerHost
+	Waits uint64
+	// Open connections, in use or idle, and how many of them are idle
+	Open int
+	Idle int
+}
+
+// hostPool holds the connections to one scheme, host and port
+type hostPool struct {
+	idle []*persistConn // most recently used last
+	open int
+	// requests waiting for a connection slot, woken in order
+	waiters []chan struct{}
+}
+
+// persistConn is a connection that may carry several exchanges
+type persistConn struct {
+	key  string
+	conn net.Conn
+	// the TCP connection under conn, for health checks
+	raw   net.Conn
+	timer *time.Timer
+	// reused is set once the connection came out of the pool
+	reused bool
+}
+
+func (c *Client) maxIdlePerHost() int {
+	if c.MaxIdlePerHost == 0 {
+		return DefaultMaxIdlePerHost
+	}
+	return c.MaxIdlePerHost
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+// pool returns the pool for key, c.mu must be held
+func (c *Client) pool(key string) *hostPool {
+	if c.pools == nil {
+		c.pools = map[string]*hostPool{}
+	}
+	p := c.pools[key]
+	if p == nil {
+		p = &hostPool{}
+		c.pools[key] = p
+	}
+	return p
+}
+
+// getConn hands out an idle connection to key or dials a new one. With
+// MaxConnsPerHost reached it waits for a connection to come back.
+func (c *Client) getConn(ctx context.Context, key string, dial func() (net.Conn, error)) (*persistConn, error) {
+	for {
+		c.mu.Lock()
+		p := c.pool(key)
+		if n := len(p.idle); n > 0 {
+			pc := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			pc.timer.Stop()
+			c.mu.Unlock()
+
+			if pc.healthy() {
+				pc.reused = true
+				c.mu.Lock()
+				c.stats.Hits++
+				c.mu.Unlock()
+				return pc, nil
+			}
+			c.closeConn(pc)
+			continue
+		}
+
+		if c.MaxConnsPerHost <= 0 || p.open < c.MaxConnsPerHost {
+			p.open++
+			c.stats.Misses++
+			c.mu.Unlock()
+			conn, err := dial()
+			if err != nil {
+				c.closeConn(&persistConn{key: key})
+				return nil, err
+			}
+			return newPersistConn(key, conn), nil
+		}
+
+		wake := make(chan struct{}, 1)
+		p.waiters = append(p.waiters, wake)
+		c.stats.Waits++
+		c.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			c.mu.Lock()
+			if !p.removeWaiter(wake) {
+				// woken already, the slot goes to the next in line
+				p.wakeOne()
+			}
+			c.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func newPersistConn(key string, conn net.Conn) *persistConn {
+	pc := &persistConn{key: key, conn: conn, raw: conn}
+	if netConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		pc.raw = netConn.NetConn()
+	}
+	return pc
+}
+
+// putConn keeps pc for the next request to its host, or closes it when
+// enough are idle already
+func (c *Client) putConn(pc *persistConn) {
+	max := c.maxIdlePerHost()
+	c.mu.Lock()
+	p := c.pool(pc.key)
+	if max < 0 || len(p.idle) >= max {
+		c.mu.Unlock()
+		c.closeConn(pc)
+		return
+	}
+	p.idle = append(p.idle, pc)
+	pc.timer = time.AfterFunc(c.idleTimeout(), func() {
+		c.mu.Lock()
+		removed := p.removeIdle(pc)
+		c.mu.Unlock()
+		if removed {
+			c.closeConn(pc)
+		}
+	})
+	p.wakeOne()
+	c.mu.Unlock()
+}
+
+// closeConn closes pc and frees its slot for a waiting request
+func (c *Client) closeConn(pc *persistConn) {
+	if pc.conn != nil {
+		pc.conn.Close()
+	}
+	c.mu.Lock()
+	p := c.pool(pc.key)
+	p.open--
+	p.wakeOne()
+	c.mu.Unlock()
+}
+
+// CloseIdleConnections closes every kept-alive connection not in use
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	var idle []*persistConn
+	for _, p := range c.pools {
+		idle = append(idle, p.idle...)
+		p.idle = nil
+	}
+	c.mu.Unlock()
+	for _, pc := range idle {
+		pc.timer.Stop()
+		c.closeConn(pc)
+	}
+}
+
+// Stats returns the counters and the connections open right now
+func (c *Client) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	for _, p := range c.pools {
+		stats.Open += p.open
+		stats.Idle += len(p.idle)
+	}
+	return stats
+}
+
+func (p *hostPool) wakeOne() {
+	if len(p.waiters) == 0 {
+		return
+	}
+	p.waiters[0] <- struct{}{}
+	p.waiters = p.waiters[1:]
+}
+
+func (p *hostPool) removeWaiter(wake chan struct{}) bool {
+	for i, w := range p.waiters {
+		if w == wake {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *hostPool) removeIdle(pc *persistConn) bool {
+	for i, idle := range p.idle {
+		if idle == pc {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// healthy checks that the server hasn't closed the connection or sent
+// anything unasked while it was idle. Reading with a short deadline finds
+// out without waiting.
+func (pc *persistConn) healthy() bool {
+	pc.raw.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := pc.raw.Read(b[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return pc.conn.SetDeadline(time.Time{}) == nil
+}
@@ -0,0 +1,93 @@
+package compress
+
+import (
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strconv"
+	"strings"
+)
+
+// bodies smaller than this are not worth compressing
+const DefaultMinSize = 1024
+
+type Options struct {
+	// MinSize is the smallest buffered body that gets compressed
+	MinSize int
+	// Encodings in order of preference, for ties in Accept-Encoding.
+	// Encodings without a registered response encoder are skipped, br
+	// e.g. can be listed once response.RegisterEncoder knows it.
+	Encodings []string
+}
+
+var DefaultOptions = Options{
+	MinSize:   DefaultMinSize,
+	Encodings: []string{"zstd", "gzip", "deflate"},
+}
+
+// Handler compresses the responses of h with DefaultOptions
+func Handler(h server.Handler) server.Handler {
+	return HandlerWithOptions(h, DefaultOptions)
+}
+
+// HandlerWithOptions picks a content-coding from the request's
+// Accept-Encoding and tells the response writer to use it
+func HandlerWithOptions(h server.Handler, opts Options) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		acceptEncoding, _ := req.Headers.Get("accept-encoding")
+		w.SetCompression(Negotiate(acceptEncoding, opts.Encodings), opts.MinSize)
+		h(w, req)
+	}
+}
+
+// Negotiate returns the best of the offered encodings for an
+// Accept-Encoding value, or "" if the body should stay as it is
+func Negotiate(acceptEncoding string, offered []string) string {
+	qualities := parseAcceptEncoding(acceptEncoding)
+
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range offered {
+		if !response.HasEncoder(encoding) {
+			continue
+		}
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		// offered is ordered by preference, so only a higher q wins
+		if ok && q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// parseAcceptEncoding maps each coding to its q value, e.g.
+// "gzip;q=0.8, br" -> {gzip: 0.8, br: 1}
+func parseAcceptEncoding(value string) map[string]float64 {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			name, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		qualities[coding] = q
+	}
+	return qualities
+}
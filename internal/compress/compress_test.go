@@ -0,0 +1,186 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	offered := []string{"br", "zstd", "gzip", "deflate"}
+
+	// Test: first supported encoding wins ties
+	assert.Equal(t, "gzip", Negotiate("deflate, gzip", offered))
+
+	// Test: q values
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0.5, deflate;q=0.9", offered))
+
+	// Test: wildcard and explicit refusal
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0, zstd;q=0, *", offered))
+
+	// Test: nothing acceptable
+	assert.Equal(t, "", Negotiate("compress", offered))
+	assert.Equal(t, "", Negotiate("", offered))
+
+	// Test: br is skipped without a registered encoder
+	assert.Equal(t, "", Negotiate("br", offered))
+	assert.Equal(t, "zstd", Negotiate("*", offered))
+
+	// Test: a browser offering all three gets zstd by default
+	assert.Equal(t, "zstd", Negotiate("gzip, deflate, br, zstd", DefaultOptions.Encodings))
+
+	// Test: the defaults only list encodings that can be produced
+	for _, encoding := range DefaultOptions.Encodings {
+		assert.True(t, response.HasEncoder(encoding), encoding)
+	}
+}
+
+func serve(t *testing.T, acceptEncoding, contentType string, body []byte) string {
+	return serveHandler(t, "Accept-Encoding: "+acceptEncoding+"\r\n", func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Content-Type", contentType)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody(body)
+	})
+}
+
+func serveHandler(t *testing.T, fields string, handler func(w *response.Writer, req *request.Request)) string {
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n" + fields + "\r\n"))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	w := response.NewBufferedWriter(&out, 64*1024)
+	Handler(handler)(w, req)
+	require.NoError(t, w.Finish())
+	return out.String()
+}
+
+func TestHandler(t *testing.T) {
+	body := []byte(strings.Repeat("hello compression ", 200))
+
+	// Test: gzip with a computed Content-Length
+	out := serve(t, "gzip", "text/html", body)
+	assert.Contains(t, out, "content-encoding: gzip\r\n")
+	assert.Contains(t, out, "vary: Accept-Encoding\r\n")
+	assert.Contains(t, out, "content-length: ")
+	_, compressed, _ := strings.Cut(out, "\r\n\r\n")
+	gz, err := gzip.NewReader(strings.NewReader(compressed))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, body, plain)
+
+	// Test: zstd
+	out = serve(t, "zstd", "text/html", body)
+	assert.Contains(t, out, "content-encoding: zstd\r\n")
+	_, compressed, _ = strings.Cut(out, "\r\n\r\n")
+	zr, err := zstd.NewReader(strings.NewReader(compressed))
+	require.NoError(t, err)
+	defer zr.Close()
+	plain, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, plain)
+
+	// Test: tiny bodies are left alone
+	out = serve(t, "gzip", "text/html", []byte("tiny"))
+	assert.NotContains(t, out, "content-encoding")
+	assert.Contains(t, out, "vary: Accept-Encoding\r\n")
+
+	// Test: already compressed content types are left alone
+	out = serve(t, "gzip", "image/png", body)
+	assert.NotContains(t, out, "content-encoding")
+}
+
+func TestHandlerValidators(t *testing.T) {
+	body := strings.Repeat("hello compression ", 200)
+	content := func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("ETag", `"v1"`)
+		h.Set("Content-Type", "text/plain")
+		response.ServeContent(w, req, "", time.Time{}, strings.NewReader(body), h)
+	}
+
+	// Test: a compressed body is tagged apart from the identity one
+	out := serveHandler(t, "Accept-Encoding: gzip\r\n", content)
+	assert.Contains(t, out, "content-encoding: gzip\r\n")
+	assert.Contains(t, out, "etag: \"v1-gzip\"\r\n")
+
+	// Test: the identity body keeps its tag
+	out = serveHandler(t, "Accept-Encoding: identity\r\n", content)
+	assert.NotContains(t, out, "content-encoding")
+	assert.Contains(t, out, "etag: \"v1\"\r\n")
+
+	// Test: the compressed tag revalidates
+	out = serveHandler(t, "Accept-Encoding: gzip\r\nIf-None-Match: \"v1-gzip\"\r\n", content)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 "), out)
+	assert.Contains(t, out, "etag: \"v1-gzip\"\r\n")
+
+	// Test: partial content is never compressed, multipart included
+	out = serveHandler(t, "Accept-Encoding: gzip\r\nRange: bytes=0-99\r\n", content)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 "), out)
+	assert.NotContains(t, out, "content-encoding")
+	out = serveHandler(t, "Accept-Encoding: gzip\r\nRange: bytes=0-999,2000-2999\r\n", content)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 "), out)
+	assert.Contains(t, out, "multipart/byteranges")
+	assert.NotContains(t, out, "content-encoding")
+}
+
+func TestDecodeRequests(t *testing.T) {
+	var got []byte
+	echo := func(w *response.Writer, req *request.Request) {
+		got = req.Body
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(0))
+	}
+	post := func(h server.Handler, encoding string, body []byte) string {
+		req, err := request.RequestFromReader(strings.NewReader(fmt.Sprintf("POST / HTTP/1.1\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n%s", encoding, len(body), body)))
+		require.NoError(t, err)
+		var out bytes.Buffer
+		w := response.NewBufferedWriter(&out, 64*1024)
+		h(w, req)
+		require.NoError(t, w.Finish())
+		return out.String()
+	}
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(b)
+		gz.Close()
+		return buf.Bytes()
+	}
+	plain := []byte(strings.Repeat("hello ", 100))
+
+	// Test: the handler sees the decoded body, the default limit applies for 0
+	out := post(DecodeRequests(echo, 0), "gzip", gzipped(plain))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 "), out)
+	assert.Equal(t, plain, got)
+
+	// Test: over the limit is a 413
+	got = nil
+	out = post(DecodeRequests(echo, 100), "gzip", gzipped(plain))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 "), out)
+	assert.Nil(t, got)
+
+	// Test: an unknown coding is a 415 naming the ones we take
+	out = post(DecodeRequests(echo, 0), "br", plain)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 "), out)
+	assert.Contains(t, out, "accept-encoding: gzip, x-gzip, deflate\r\n")
+	assert.Nil(t, got)
+
+	// Test: a corrupt body is a 400
+	out = post(DecodeRequests(echo, 0), "gzip", plain)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 "), out)
+}
@@ -0,0 +1,38 @@
+package compress
+
+import (
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strings"
+)
+
+// largest decoded request body DecodeRequests accepts by default
+const DefaultMaxDecodedSize = 10 << 20
+
+// DecodeRequests decodes gzip/deflate request bodies before h runs.
+// Unsupported codings get a 415 that lists what we accept, bodies that
+// decode to more than maxSize bytes a 413 and corrupt ones a 400.
+// maxSize <= 0 means DefaultMaxDecodedSize.
+func DecodeRequests(h server.Handler, maxSize int) server.Handler {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecodedSize
+	}
+	return func(w *response.Writer, req *request.Request) {
+		err := req.DecodeBody(maxSize)
+		if err == nil {
+			h(w, req)
+			return
+		}
+
+		he := server.DecodeError(err)
+		if errors.Is(err, request.ERROR_UNSUPPORTED_MEDIA_TYPE) {
+			// RFC 9110 15.5.16: say which codings would have worked
+			he.Headers = headers.NewHeaders()
+			he.Headers.Set("Accept-Encoding", strings.Join(request.SupportedEncodings, ", "))
+		}
+		he.Write(w)
+	}
+}
@@ -141,3 +141,24 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 
 	return read, done, nil
 }
+
+// HasToken reports whether the comma separated header name lists token,
+// compared case-insensitively, e.g. Connection: keep-alive, Upgrade
+func (h *Headers) HasToken(name, token string) bool {
+	value, _ := h.Get(name)
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone returns a copy that can be changed without touching h
+func (h *Headers) Clone() *Headers {
+	c := NewHeaders()
+	for n, v := range h.headers {
+		c.headers[n] = v
+	}
+	return c
+}
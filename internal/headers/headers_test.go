@@ -59,3 +59,17 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, "Go", value)
 
 }
+
+func TestHasToken(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("Connection", "keep-alive, Upgrade")
+	headers.Add("Connection", "HTTP2-Settings")
+
+	// Test: tokens match case-insensitively across joined values
+	assert.True(t, headers.HasToken("connection", "upgrade"))
+	assert.True(t, headers.HasToken("Connection", "http2-settings"))
+
+	// Test: substrings and missing headers don't match
+	assert.False(t, headers.HasToken("connection", "keep"))
+	assert.False(t, headers.HasToken("upgrade", "websocket"))
+}
@@ -0,0 +1,137 @@
+package hpack
+
+type Decoder struct {
+	table dynamicTable
+	// the most a size update may ask for, our SETTINGS_HEADER_TABLE_SIZE
+	allowedMaxSize int
+	// largest header list Decode returns, 0 for no limit
+	maxHeaderListSize int
+}
+
+// NewDecoder returns a decoder whose table may grow to maxTableSize
+func NewDecoder(maxTableSize int) *Decoder {
+	return &Decoder{table: dynamicTable{maxSize: maxTableSize}, allowedMaxSize: maxTableSize}
+}
+
+// SetAllowedMaxTableSize changes the limit for size updates, e.g. when a
+// new SETTINGS_HEADER_TABLE_SIZE was acknowledged
+func (d *Decoder) SetAllowedMaxTableSize(n int) {
+	d.allowedMaxSize = n
+	if d.table.maxSize > n {
+		d.table.setMaxSize(n)
+	}
+}
+
+// SetMaxHeaderListSize limits the decoded size of a header block, the
+// sum of Size over its fields, e.g. to our SETTINGS_MAX_HEADER_LIST_SIZE.
+// 0 turns the limit off.
+func (d *Decoder) SetMaxHeaderListSize(n int) {
+	d.maxHeaderListSize = n
+}
+
+// TableSize is the current size of the dynamic table
+func (d *Decoder) TableSize() int {
+	return d.table.size
+}
+
+// Decode turns a complete header block into fields, in order. An error
+// leaves the table in an unknown state: HTTP/2 ends the connection with
+// COMPRESSION_ERROR.
+// The exception is ERROR_HEADER_LIST_TOO_LARGE: the rest of the block is
+// still decoded into the table, just not kept, so the connection can go
+// on and only the one request is refused.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	listSize := 0
+	emit := func(f HeaderField) {
+		// a field can be tiny on the wire and huge decoded, RFC 7541 7.4
+		listSize += f.Size()
+		if d.maxHeaderListSize > 0 && listSize > d.maxHeaderListSize {
+			fields = nil
+			return
+		}
+		fields = append(fields, f)
+	}
+	// size updates are only allowed before the first field
+	sawField := false
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed field, RFC 7541 6.1
+			index, n, err := readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f, err := d.table.field(index)
+			if err != nil {
+				return nil, err
+			}
+			emit(f)
+			sawField = true
+
+		case b&0xC0 == 0x40: // literal with incremental indexing, 6.2.1
+			f, n, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			d.table.add(f)
+			emit(f)
+			sawField = true
+
+		case b&0xE0 == 0x20: // dynamic table size update, 6.3
+			size, n, err := readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if sawField || size > uint64(d.allowedMaxSize) {
+				return nil, ERROR_TABLE_SIZE_UPDATE
+			}
+			block = block[n:]
+			d.table.setMaxSize(int(size))
+
+		default: // literal without indexing (6.2.2) or never indexed (6.2.3)
+			f, n, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0x10 != 0
+			block = block[n:]
+			emit(f)
+			sawField = true
+		}
+	}
+	if d.maxHeaderListSize > 0 && listSize > d.maxHeaderListSize {
+		return nil, ERROR_HEADER_LIST_TOO_LARGE
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, int, error) {
+	index, n, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	var f HeaderField
+	if index > 0 {
+		indexed, err := d.table.field(index)
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = indexed.Name
+	} else {
+		name, m, err := readString(block[n:])
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = name
+		n += m
+	}
+	value, m, err := readString(block[n:])
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	f.Value = value
+	return f, n + m, nil
+}
@@ -0,0 +1,70 @@
+package hpack
+
+type Encoder struct {
+	table dynamicTable
+
+	// size changes not yet sent to the peer, RFC 7541 4.2
+	pendingUpdate bool
+	minSize       int
+
+	// NoHuffman sends every string as is
+	NoHuffman bool
+}
+
+// NewEncoder returns an encoder whose table may grow to maxTableSize, the
+// peer's SETTINGS_HEADER_TABLE_SIZE
+func NewEncoder(maxTableSize int) *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: maxTableSize}}
+}
+
+// SetMaxTableSize changes the table size, e.g. after new SETTINGS. The
+// next block starts with the size update(s) the decoder needs.
+func (e *Encoder) SetMaxTableSize(n int) {
+	if !e.pendingUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// TableSize is the current size of the dynamic table
+func (e *Encoder) TableSize() int {
+	return e.table.size
+}
+
+// Encode appends the header block for fields to b. Exact matches in a
+// table become an index, everything else is added to the dynamic table
+// unless it is Sensitive or bigger than the whole table.
+func (e *Encoder) Encode(b []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		// a shrink followed by a grow has to show both, RFC 7541 4.2
+		if e.minSize < e.table.maxSize {
+			b = appendInt(b, 0x20, 5, uint64(e.minSize))
+		}
+		b = appendInt(b, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+
+	for _, f := range fields {
+		index, nameOnly := e.table.search(f)
+		if index > 0 && !nameOnly && !f.Sensitive {
+			b = appendInt(b, 0x80, 7, uint64(index))
+			continue
+		}
+
+		switch {
+		case f.Sensitive:
+			b = appendInt(b, 0x10, 4, uint64(index))
+		case f.Size() <= e.table.maxSize:
+			b = appendInt(b, 0x40, 6, uint64(index))
+			e.table.add(f)
+		default:
+			b = appendInt(b, 0x00, 4, uint64(index))
+		}
+		if index == 0 {
+			b = appendString(b, f.Name, !e.NoHuffman)
+		}
+		b = appendString(b, f.Value, !e.NoHuffman)
+	}
+	return b
+}
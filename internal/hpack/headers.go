@@ -0,0 +1,53 @@
+package hpack
+
+import (
+	"httpfromtcp/internal/headers"
+	"sort"
+	"strings"
+)
+
+// fields that carry credentials are never indexed by default
+var sensitiveFields = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+}
+
+// FromHeaders lists h as fields, names sorted so the output is stable.
+// Comma joined values stay one field.
+func FromHeaders(h *headers.Headers) []HeaderField {
+	var fields []HeaderField
+	h.ForEach(func(n, v string) {
+		fields = append(fields, HeaderField{Name: n, Value: v, Sensitive: sensitiveFields[n]})
+	})
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return fields
+}
+
+// ToHeaders collects fields into Headers. Repeated names are joined with
+// commas like the HTTP/1.1 parser does, except cookie which uses "; "
+// (RFC 9113 8.2.3). Pseudo-header fields are skipped.
+func ToHeaders(fields []HeaderField) *headers.Headers {
+	h := headers.NewHeaders()
+	var cookies []string
+	for _, f := range fields {
+		switch {
+		case strings.HasPrefix(f.Name, ":"):
+		case f.Name == "cookie":
+			cookies = append(cookies, f.Value)
+		default:
+			h.Add(f.Name, f.Value)
+		}
+	}
+	if len(cookies) > 0 {
+		h.Set("cookie", strings.Join(cookies, "; "))
+	}
+	return h
+}
+
+// EncodeHeaders appends the header block for h, after the fields in
+// pseudo (e.g. :status) which have to come first
+func (e *Encoder) EncodeHeaders(b []byte, pseudo []HeaderField, h *headers.Headers) []byte {
+	return e.Encode(b, append(pseudo[:len(pseudo):len(pseudo)], FromHeaders(h)...))
+}
@@ -0,0 +1,242 @@
+// Package hpack implements HPACK, the header compression of HTTP/2
+// (RFC 7541)
+package hpack
+
+import (
+	"fmt"
+)
+
+var ERROR_INVALID_INDEX = fmt.Errorf("hpack: invalid table index")
+var ERROR_INVALID_INTEGER = fmt.Errorf("hpack: invalid integer")
+var ERROR_INVALID_STRING = fmt.Errorf("hpack: invalid string literal")
+var ERROR_INVALID_HUFFMAN = fmt.Errorf("hpack: invalid huffman code")
+var ERROR_TABLE_SIZE_UPDATE = fmt.Errorf("hpack: invalid dynamic table size update")
+var ERROR_HEADER_LIST_TOO_LARGE = fmt.Errorf("hpack: header list too large")
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are sent as never indexed literals, so neither
+	// this hop nor an intermediary puts them in a table (RFC 7541 7.1.3)
+	Sensitive bool
+}
+
+// Size is what the field takes up in the dynamic table, RFC 7541 4.1
+func (f HeaderField) Size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// DefaultTableSize is the initial SETTINGS_HEADER_TABLE_SIZE of HTTP/2
+const DefaultTableSize = 4096
+
+// staticTable is RFC 7541 Appendix A, index 1 is staticTable[0]
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable keeps the newest entry first, RFC 7541 2.3.2
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	f.Sensitive = false
+	t.entries = append([]HeaderField{f}, t.entries...)
+	t.size += f.Size()
+	// an entry bigger than the table empties it, RFC 7541 4.4
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	for t.size > t.maxSize && len(t.entries) > 0 {
+		last := t.entries[len(t.entries)-1]
+		t.entries = t.entries[:len(t.entries)-1]
+		t.size -= last.Size()
+	}
+}
+
+// field looks up an index of the combined address space, RFC 7541 2.3.3
+func (t *dynamicTable) field(index uint64) (HeaderField, error) {
+	switch {
+	case index == 0:
+		return HeaderField{}, ERROR_INVALID_INDEX
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	case index-uint64(len(staticTable)) <= uint64(len(t.entries)):
+		return t.entries[index-uint64(len(staticTable))-1], nil
+	}
+	return HeaderField{}, ERROR_INVALID_INDEX
+}
+
+// search returns the index of an entry equal to f, or failing that of one
+// with the same name (nameOnly is then true). The static table wins ties.
+func (t *dynamicTable) search(f HeaderField) (index int, nameOnly bool) {
+	for i, s := range staticTable {
+		if s.Name != f.Name {
+			continue
+		}
+		if s.Value == f.Value {
+			return i + 1, false
+		}
+		if index == 0 {
+			index = i + 1
+		}
+	}
+	for i, d := range t.entries {
+		if d.Name != f.Name {
+			continue
+		}
+		if d.Value == f.Value {
+			return len(staticTable) + i + 1, false
+		}
+		if index == 0 {
+			index = len(staticTable) + i + 1
+		}
+	}
+	return index, index != 0
+}
+
+// readInt decodes an integer with an N-bit prefix, RFC 7541 5.1
+func readInt(b []byte, prefix uint8) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, ERROR_INVALID_INTEGER
+	}
+	max := uint64(1)<<prefix - 1
+	value := uint64(b[0]) & max
+	if value < max {
+		return value, 1, nil
+	}
+	var shift uint
+	for i := 1; i < len(b); i++ {
+		value += uint64(b[i]&0x7F) << shift
+		if b[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		shift += 7
+		// nothing a sane peer sends needs more than 32 bits
+		if shift > 28 {
+			return 0, 0, ERROR_INVALID_INTEGER
+		}
+	}
+	return 0, 0, ERROR_INVALID_INTEGER
+}
+
+// appendInt encodes value with an N-bit prefix, first carries the bits
+// above the prefix
+func appendInt(b []byte, first byte, prefix uint8, value uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if value < max {
+		return append(b, first|byte(value))
+	}
+	b = append(b, first|byte(max))
+	value -= max
+	for value >= 0x80 {
+		b = append(b, byte(value&0x7F)|0x80)
+		value >>= 7
+	}
+	return append(b, byte(value))
+}
+
+// readString decodes a string literal, RFC 7541 5.2
+func readString(b []byte) (string, int, error) {
+	if len(b) == 0 {
+		return "", 0, ERROR_INVALID_STRING
+	}
+	huffman := b[0]&0x80 != 0
+	length, n, err := readInt(b, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(b)-n) < length {
+		return "", 0, ERROR_INVALID_STRING
+	}
+	raw := b[n : n+int(length)]
+	if !huffman {
+		return string(raw), n + int(length), nil
+	}
+	s, err := HuffmanDecode(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	return s, n + int(length), nil
+}
+
+// appendString writes s as a string literal, Huffman coded unless that
+// makes it longer
+func appendString(b []byte, s string, huffman bool) []byte {
+	if huffman {
+		if n := HuffmanEncodedLen(s); n <= len(s) {
+			b = appendInt(b, 0x80, 7, uint64(n))
+			return AppendHuffman(b, s)
+		}
+	}
+	b = appendInt(b, 0x00, 7, uint64(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,241 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"httpfromtcp/internal/headers"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the examples of RFC 7541 Appendix C, blocks of one case share a table
+type vectorCase struct {
+	Name      string `json:"name"`
+	TableSize int    `json:"tableSize"`
+	Encode    bool   `json:"encode"`
+	Huffman   bool   `json:"huffman"`
+	Blocks    []struct {
+		Wire      string      `json:"wire"`
+		Fields    [][2]string `json:"fields"`
+		Sensitive bool        `json:"sensitive"`
+		TableSize int         `json:"tableSize"`
+	} `json:"blocks"`
+}
+
+func loadVectors(t *testing.T) []vectorCase {
+	data, err := os.ReadFile("testdata/rfc7541.json")
+	require.NoError(t, err)
+	var cases []vectorCase
+	require.NoError(t, json.Unmarshal(data, &cases))
+	return cases
+}
+
+func TestVectors(t *testing.T) {
+	for _, c := range loadVectors(t) {
+		t.Run(c.Name, func(t *testing.T) {
+			d := NewDecoder(c.TableSize)
+			e := NewEncoder(c.TableSize)
+			e.NoHuffman = !c.Huffman
+			for _, block := range c.Blocks {
+				wire, err := hex.DecodeString(block.Wire)
+				require.NoError(t, err)
+				var want []HeaderField
+				for _, f := range block.Fields {
+					want = append(want, HeaderField{Name: f[0], Value: f[1], Sensitive: block.Sensitive})
+				}
+
+				// Test: decoding gives the fields and the table size of the RFC
+				fields, err := d.Decode(wire)
+				require.NoError(t, err)
+				assert.Equal(t, want, fields)
+				assert.Equal(t, block.TableSize, d.TableSize())
+
+				// Test: the encoder makes the same choices byte for byte
+				if c.Encode {
+					assert.Equal(t, block.Wire, hex.EncodeToString(e.Encode(nil, want)))
+					assert.Equal(t, block.TableSize, e.TableSize())
+				}
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	// Test: RFC 7541 C.4, three requests with Huffman coding sharing one dynamic table
+	d := NewDecoder(DefaultTableSize)
+	for _, c := range []struct {
+		block  string
+		fields []HeaderField
+		size   int
+	}{
+		{"828684418cf1e3c2e5f23a6ba0ab90f4ff", []HeaderField{
+			{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"},
+		}, 57},
+		{"828684be5886a8eb10649cbf", []HeaderField{
+			{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"},
+			{Name: "cache-control", Value: "no-cache"},
+		}, 110},
+		{"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf", []HeaderField{
+			{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "https"}, {Name: ":path", Value: "/index.html"}, {Name: ":authority", Value: "www.example.com"},
+			{Name: "custom-key", Value: "custom-value"},
+		}, 164},
+	} {
+		block, err := hex.DecodeString(c.block)
+		require.NoError(t, err)
+		fields, err := d.Decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, c.fields, fields)
+		assert.Equal(t, c.size, d.TableSize())
+	}
+
+	// Test: what the encoder writes decodes back
+	fields := []HeaderField{{Name: ":status", Value: "200"}, {Name: "content-type", Value: "text/plain"}, {Name: "x-custom", Value: strings.Repeat("v", 200)}}
+	decoded, err := NewDecoder(DefaultTableSize).Decode(NewEncoder(DefaultTableSize).Encode(nil, fields))
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: broken blocks
+	for _, c := range []struct {
+		block string
+		err   error
+	}{
+		{"80", ERROR_INVALID_INDEX},
+		{"ff", ERROR_INVALID_INTEGER},
+		{"be", ERROR_INVALID_INDEX},
+		{"3fe21f", ERROR_TABLE_SIZE_UPDATE},
+		{"0085f2b24a84ff", ERROR_INVALID_STRING},
+	} {
+		b, _ := hex.DecodeString(c.block)
+		_, err := NewDecoder(DefaultTableSize).Decode(b)
+		assert.ErrorIs(t, err, c.err, c.block)
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: every byte value survives a round trip
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	for _, s := range []string{"", "a", "www.example.com", "no-cache", all.String()} {
+		encoded := AppendHuffman(nil, s)
+		assert.Len(t, encoded, HuffmanEncodedLen(s))
+		decoded, err := HuffmanDecode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, s, decoded)
+	}
+
+	// Test: padding must be short and all ones, EOS is not allowed
+	for _, bad := range []string{
+		"18",       // 'a' padded with zeros
+		"ffffffff", // more than 7 bits of padding
+		"fffffffc", // EOS
+	} {
+		b, _ := hex.DecodeString(bad)
+		_, err := HuffmanDecode(b)
+		assert.ErrorIs(t, err, ERROR_INVALID_HUFFMAN, bad)
+	}
+}
+
+func TestTableSizeUpdate(t *testing.T) {
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	fields := []HeaderField{{Name: "x-custom", Value: "value"}}
+
+	// Test: a shrink and a grow between blocks are both signalled, smallest first
+	e.Encode(nil, fields)
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(100)
+	block := e.Encode(nil, fields)
+	assert.Equal(t, "203f45", hex.EncodeToString(block[:3]))
+	assert.Equal(t, 45, e.TableSize())
+
+	_, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, 45, d.TableSize())
+
+	// Test: the encoder does not index what cannot fit, the decoder empties its table for it
+	big := HeaderField{Name: "x-big", Value: strings.Repeat("v", 200)}
+	e.Encode(nil, []HeaderField{big})
+	assert.Equal(t, 45, e.TableSize())
+	block = appendInt(nil, 0x40, 6, 0)
+	block = appendString(block, big.Name, false)
+	block = appendString(block, big.Value, false)
+	fields, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{big}, fields)
+	assert.Equal(t, 0, d.TableSize())
+
+	// Test: updates over the limit or after a field are errors
+	for _, bad := range []string{"3fe21f", "823f45"} {
+		b, _ := hex.DecodeString(bad)
+		_, err := NewDecoder(DefaultTableSize).Decode(b)
+		assert.ErrorIs(t, err, ERROR_TABLE_SIZE_UPDATE, bad)
+	}
+	d = NewDecoder(DefaultTableSize)
+	d.SetAllowedMaxTableSize(100)
+	_, err = d.Decode([]byte{0x3f, 0x46})
+	assert.ErrorIs(t, err, ERROR_TABLE_SIZE_UPDATE)
+}
+
+func TestMaxHeaderListSize(t *testing.T) {
+	e := NewEncoder(DefaultTableSize)
+	d := NewDecoder(DefaultTableSize)
+	d.SetMaxHeaderListSize(100)
+	small := HeaderField{Name: "x-small", Value: "v"}
+	big := HeaderField{Name: "x-big", Value: strings.Repeat("v", 60)}
+
+	// Test: fields add up as name + value + 32
+	fields, err := d.Decode(e.Encode(nil, []HeaderField{small, small}))
+	require.NoError(t, err)
+	assert.Len(t, fields, 2)
+
+	// Test: a block over the limit is refused but still fills the table
+	_, err = d.Decode(e.Encode(nil, []HeaderField{small, big}))
+	require.ErrorIs(t, err, ERROR_HEADER_LIST_TOO_LARGE)
+	assert.Equal(t, e.TableSize(), d.TableSize())
+
+	// Test: the next block decodes against the same table, indexed references included
+	fields, err = d.Decode(e.Encode(nil, []HeaderField{big}))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{big}, fields)
+
+	// Test: repeating one indexed field is small on the wire only
+	block := e.Encode(nil, []HeaderField{big})
+	_, err = d.Decode(append(append([]byte{}, block...), block...))
+	assert.ErrorIs(t, err, ERROR_HEADER_LIST_TOO_LARGE)
+}
+
+func TestHeaders(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Authorization", "Bearer secret")
+	h.Add("Vary", "Accept-Encoding")
+	h.Add("Vary", "Origin")
+
+	// Test: headers go out sorted after the pseudo-header fields, credentials never indexed
+	e := NewEncoder(DefaultTableSize)
+	block := e.EncodeHeaders(nil, []HeaderField{{Name: ":status", Value: "200"}}, h)
+	fields, err := NewDecoder(DefaultTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "authorization", Value: "Bearer secret", Sensitive: true},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "vary", Value: "Accept-Encoding,Origin"},
+	}, fields)
+
+	// Test: back to Headers, cookies joined the HTTP/2 way
+	fields = append(fields, HeaderField{Name: "cookie", Value: "a=1"}, HeaderField{Name: "cookie", Value: "b=2"})
+	back := ToHeaders(fields)
+	_, ok := back.Get(":status")
+	assert.False(t, ok)
+	cookie, _ := back.Get("cookie")
+	assert.Equal(t, "a=1; b=2", cookie)
+	vary, _ := back.Get("vary")
+	assert.Equal(t, "Accept-Encoding,Origin", vary)
+}
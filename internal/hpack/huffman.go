@@ -0,0 +1,93 @@
+package hpack
+
+import (
+	"strings"
+)
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   int // -1 for inner nodes
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{symbol: -1}
+	for symbol, c := range huffmanCodes {
+		node := root
+		for i := int(c.bits) - 1; i >= 0; i-- {
+			bit := (c.code >> uint(i)) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &huffmanNode{symbol: -1}
+			}
+			node = node.children[bit]
+		}
+		node.symbol = symbol
+	}
+	return root
+}
+
+// HuffmanDecode walks the code tree bit by bit. The padding at the end
+// must be the most significant bits of EOS (all ones) and shorter than a
+// byte, RFC 7541 5.2.
+func HuffmanDecode(b []byte) (string, error) {
+	var sb strings.Builder
+	node := huffmanRoot
+	depth := 0
+	allOnes := true
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			bit := (c >> uint(i)) & 1
+			node = node.children[bit]
+			if node == nil {
+				return "", ERROR_INVALID_HUFFMAN
+			}
+			depth++
+			allOnes = allOnes && bit == 1
+			if node.symbol < 0 {
+				continue
+			}
+			if node.symbol == 256 {
+				return "", ERROR_INVALID_HUFFMAN
+			}
+			sb.WriteByte(byte(node.symbol))
+			node = huffmanRoot
+			depth = 0
+			allOnes = true
+		}
+	}
+	if depth > 7 || !allOnes {
+		return "", ERROR_INVALID_HUFFMAN
+	}
+	return sb.String(), nil
+}
+
+// HuffmanEncodedLen is the length of s once Huffman coded
+func HuffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffman appends the Huffman code of s, padded with the first bits
+// of EOS
+func AppendHuffman(b []byte, s string) []byte {
+	var acc uint64 // pending bits, right aligned
+	n := 0         // number of pending bits
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		n += int(c.bits)
+		for n >= 8 {
+			n -= 8
+			b = append(b, byte(acc>>uint(n)))
+		}
+	}
+	if n > 0 {
+		pad := 8 - n
+		b = append(b, byte(acc<<uint(pad))|byte(1<<uint(pad)-1))
+	}
+	return b
+}
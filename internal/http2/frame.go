@@ -0,0 +1,148 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface starts every HTTP/2 connection, RFC 9113 3.4
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+const frameHeaderLen = 9
+
+// limits from RFC 9113 4.2 and 6.5.2
+const (
+	defaultMaxFrameSize = 1 << 14
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads the next frame, refusing payloads over maxSize (our
+// SETTINGS_MAX_FRAME_SIZE)
+func readFrame(r io.Reader, maxSize uint32) (frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frame{}, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := frame{
+		typ:      frameType(head[3]),
+		flags:    head[4],
+		streamID: binary.BigEndian.Uint32(head[5:]) & 0x7FFFFFFF,
+	}
+	if length > maxSize {
+		return f, connError(ErrCodeFrameSize, "frame of %d bytes", length)
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func appendFrameHeader(b []byte, typ frameType, flags uint8, streamID uint32, length int) []byte {
+	b = append(b, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	return binary.BigEndian.AppendUint32(b, streamID&0x7FFFFFFF)
+}
+
+// stripPadding removes the Pad Length byte and the padding of DATA and
+// HEADERS frames, RFC 9113 6.1
+func stripPadding(f frame) ([]byte, error) {
+	payload := f.payload
+	if !f.has(flagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, connError(ErrCodeFrameSize, "padded frame without pad length")
+	}
+	padding := int(payload[0])
+	if padding >= len(payload) {
+		return nil, connError(ErrCodeProtocol, "padding longer than the frame")
+	}
+	return payload[1 : len(payload)-padding], nil
+}
+
+// error codes, RFC 9113 7
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+// ConnError ends the whole connection with a GOAWAY
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.Code, e.Reason)
+}
+
+func connError(code ErrCode, format string, args ...any) error {
+	return &ConnError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// StreamError only resets one stream
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func streamError(id uint32, code ErrCode, format string, args ...any) error {
+	return &StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
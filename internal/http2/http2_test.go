@@ -0,0 +1,413 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks raw frames to a server on the other end of a TCP
+// connection
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	br      *bufio.Reader
+	decoder *hpack.Decoder
+	encoder *hpack.Encoder
+}
+
+func newTestClient(t *testing.T, handler Handler, settings ...[2]uint32) *testClient {
+	return newTestClientWithOptions(t, handler, Options{MaxConcurrentStreams: 4}, settings...)
+}
+
+func newTestClientWithOptions(t *testing.T, handler Handler, opts Options, settings ...[2]uint32) *testClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		ServeConn(conn, handler, opts)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), decoder: hpack.NewDecoder(hpack.DefaultTableSize), encoder: hpack.NewEncoder(hpack.DefaultTableSize)}
+
+	_, err = conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	var payload []byte
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s[0]))
+		payload = binary.BigEndian.AppendUint32(payload, s[1])
+	}
+	c.write(frameSettings, 0, 0, payload)
+
+	f := c.read()
+	require.Equal(t, frameSettings, f.typ)
+	require.False(t, f.has(flagAck))
+	c.write(frameSettings, flagAck, 0, nil)
+	f = c.read()
+	require.Equal(t, frameSettings, f.typ)
+	require.True(t, f.has(flagAck))
+	return c
+}
+
+func (c *testClient) write(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	b := appendFrameHeader(nil, typ, flags, streamID, len(payload))
+	_, err := c.conn.Write(append(b, payload...))
+	require.NoError(c.t, err)
+}
+
+// read returns the next frame that isn't a WINDOW_UPDATE
+func (c *testClient) read() frame {
+	for {
+		f, err := readFrame(c.br, maxFrameSizeLimit)
+		require.NoError(c.t, err)
+		if f.typ != frameWindowUpdate {
+			return f
+		}
+	}
+}
+
+func (c *testClient) request(streamID uint32, endStream bool, fields ...hpack.HeaderField) {
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.write(frameHeaders, flags, streamID, c.encoder.Encode(nil, fields))
+}
+
+func get(path string) []hpack.HeaderField {
+	return []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: path}, {Name: ":authority", Value: "localhost"}}
+}
+
+type testResponse struct {
+	fields []hpack.HeaderField
+	body   string
+}
+
+func (r testResponse) get(name string) string {
+	for _, f := range r.fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// responses reads frames until every stream in ids has ended
+func (c *testClient) responses(ids ...uint32) map[uint32]*testResponse {
+	out := map[uint32]*testResponse{}
+	open := len(ids)
+	for _, id := range ids {
+		out[id] = &testResponse{}
+	}
+	for open > 0 {
+		f := c.read()
+		r := out[f.streamID]
+		require.NotNil(c.t, r, "frame %d on stream %d", f.typ, f.streamID)
+		switch f.typ {
+		case frameHeaders:
+			require.True(c.t, f.has(flagEndHeaders))
+			fields, err := c.decoder.Decode(f.payload)
+			require.NoError(c.t, err)
+			r.fields = append(r.fields, fields...)
+		case frameData:
+			r.body += string(f.payload)
+		default:
+			c.t.Fatalf("unexpected frame %d", f.typ)
+		}
+		if f.has(flagEndStream) {
+			open--
+		}
+	}
+	return out
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(0)
+	h.Delete("content-length")
+	h.Set("X-Method", req.RequestLine.Method)
+	h.Set("X-Host", func() string { v, _ := req.Headers.Get("host"); return v }())
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	if req.RequestLine.RequestTarget == "/slow" {
+		time.Sleep(50 * time.Millisecond)
+	}
+	w.WriteBody([]byte(req.RequestLine.RequestTarget + " " + string(req.Body)))
+}
+
+func TestServeConn(t *testing.T) {
+	c := newTestClient(t, echoHandler)
+
+	// Test: a GET is answered with the regular handler
+	c.request(1, true, get("/hello")...)
+	r := c.responses(1)[1]
+	assert.Equal(t, "200", r.get(":status"))
+	assert.Equal(t, "text/plain", r.get("content-type"))
+	assert.Equal(t, "7", r.get("content-length"))
+	assert.Equal(t, "localhost", r.get("x-host"))
+	assert.Empty(t, r.get("connection"))
+	assert.NotEmpty(t, r.get("date"))
+	assert.Equal(t, "/hello ", r.body)
+
+	// Test: PING is echoed
+	c.write(framePing, 0, 0, []byte("12345678"))
+	f := c.read()
+	assert.Equal(t, framePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: streams are multiplexed, a slow one doesn't hold up the others
+	c.request(3, true, get("/slow")...)
+	c.request(5, true, get("/fast")...)
+	f = c.read()
+	assert.Equal(t, uint32(5), f.streamID)
+	// every header block goes through the decoder to keep its table in sync
+	_, err := c.decoder.Decode(f.payload)
+	require.NoError(t, err)
+	rs := c.responses(3, 5)
+	assert.Equal(t, "/slow ", rs[3].body)
+
+	// Test: a body in several DATA frames, one of them padded
+	c.request(7, false, append(get("/post"), hpack.HeaderField{Name: "content-length", Value: "11"})...)
+	c.write(frameData, 0, 7, []byte("hello "))
+	c.write(frameData, flagPadded|flagEndStream, 7, append([]byte{3}, "world\x00\x00\x00"...))
+	assert.Equal(t, "/post hello world", c.responses(7)[7].body)
+
+	// Test: HEAD ends the stream with the headers
+	c.request(9, true, append([]hpack.HeaderField{{Name: ":method", Value: "HEAD"}}, get("/head")[1:]...)...)
+	f = c.read()
+	assert.Equal(t, frameHeaders, f.typ)
+	assert.True(t, f.has(flagEndStream))
+	fields, err := c.decoder.Decode(f.payload)
+	require.NoError(t, err)
+	assert.Contains(t, fields, hpack.HeaderField{Name: "x-method", Value: "GET"})
+	assert.Contains(t, fields, hpack.HeaderField{Name: "content-length", Value: "6"})
+}
+
+func TestFlowControl(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(25))
+		w.WriteBody([]byte(strings.Repeat("x", 25)))
+	}, [2]uint32{settingInitialWindowSize, 10})
+
+	// Test: the server stops at the stream window and goes on after WINDOW_UPDATE
+	c.request(1, true, get("/")...)
+	f := c.read()
+	require.Equal(t, frameHeaders, f.typ)
+	f = c.read()
+	require.Equal(t, frameData, f.typ)
+	assert.Len(t, f.payload, 10)
+
+	c.write(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 10))
+	f = c.read()
+	assert.Len(t, f.payload, 10)
+	assert.False(t, f.has(flagEndStream))
+
+	// Test: raising the initial window also grows open streams
+	c.write(frameSettings, 0, 0, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(nil, settingInitialWindowSize), 100))
+	var body []byte
+	for {
+		f = c.read()
+		if f.typ == frameSettings {
+			continue
+		}
+		body = append(body, f.payload...)
+		if f.has(flagEndStream) {
+			break
+		}
+	}
+	assert.Len(t, body, 5)
+}
+
+func TestHeaderTableSize(t *testing.T) {
+	c := newTestClient(t, echoHandler, [2]uint32{settingHeaderTableSize, 0})
+
+	// Test: the first block tells the client the table is gone, nothing is indexed after
+	var blocks [][]byte
+	for _, id := range []uint32{1, 3} {
+		c.request(id, true, get("/")...)
+		f := c.read()
+		require.Equal(t, frameHeaders, f.typ)
+		_, err := c.decoder.Decode(f.payload)
+		require.NoError(t, err)
+		blocks = append(blocks, f.payload)
+		c.responses(id)
+	}
+	assert.Equal(t, byte(0x20), blocks[0][0])
+	assert.Equal(t, 0, c.decoder.TableSize())
+	assert.Len(t, blocks[1], len(blocks[0])-1)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	goAway := func(t *testing.T, c *testClient, code ErrCode) {
+		f := c.read()
+		require.Equal(t, frameGoAway, f.typ)
+		assert.Equal(t, code, ErrCode(binary.BigEndian.Uint32(f.payload[4:])), string(f.payload[8:]))
+	}
+	rstStream := func(t *testing.T, c *testClient, id uint32, code ErrCode) {
+		f := c.read()
+		require.Equal(t, frameRSTStream, f.typ)
+		assert.Equal(t, id, f.streamID)
+		assert.Equal(t, code, ErrCode(binary.BigEndian.Uint32(f.payload)))
+	}
+
+	connCases := []struct {
+		name string
+		send func(c *testClient)
+		code ErrCode
+	}{
+		{"DATA on stream 0", func(c *testClient) { c.write(frameData, 0, 0, []byte("x")) }, ErrCodeProtocol},
+		{"even stream", func(c *testClient) { c.request(2, true, get("/")...) }, ErrCodeProtocol},
+		{"PING size", func(c *testClient) { c.write(framePing, 0, 0, []byte("1234")) }, ErrCodeFrameSize},
+		{"WINDOW_UPDATE of 0", func(c *testClient) { c.write(frameWindowUpdate, 0, 0, make([]byte, 4)) }, ErrCodeProtocol},
+		{"bad hpack", func(c *testClient) { c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, []byte{0x80}) }, ErrCodeCompression},
+		{"interrupted header block", func(c *testClient) {
+			c.write(frameHeaders, 0, 1, c.encoder.Encode(nil, get("/")))
+			c.write(framePing, 0, 0, []byte("12345678"))
+		}, ErrCodeProtocol},
+		{"frame too big", func(c *testClient) { c.write(frameData, 0, 1, make([]byte, defaultMaxFrameSize+1)) }, ErrCodeFrameSize},
+		{"push promise", func(c *testClient) { c.write(framePushPromise, flagEndHeaders, 1, make([]byte, 4)) }, ErrCodeProtocol},
+	}
+	for _, tc := range connCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, echoHandler)
+			tc.send(c)
+			goAway(t, c, tc.code)
+		})
+	}
+
+	streamCases := []struct {
+		name   string
+		fields []hpack.HeaderField
+	}{
+		{"uppercase name", append(get("/"), hpack.HeaderField{Name: "X-Upper", Value: "1"})},
+		{"connection header", append(get("/"), hpack.HeaderField{Name: "connection", Value: "keep-alive"})},
+		{"missing path", get("")},
+		{"pseudo after regular", append([]hpack.HeaderField{{Name: "accept", Value: "*/*"}}, get("/")...)},
+	}
+	for _, tc := range streamCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, echoHandler)
+			c.request(1, true, tc.fields...)
+			rstStream(t, c, 1, ErrCodeProtocol)
+
+			// the connection itself is fine
+			c.request(3, true, get("/ok")...)
+			assert.Equal(t, "/ok ", c.responses(3)[3].body)
+		})
+	}
+
+	// Test: a body that doesn't match content-length
+	c := newTestClient(t, echoHandler)
+	c.request(1, false, append(get("/"), hpack.HeaderField{Name: "content-length", Value: "10"})...)
+	c.write(frameData, flagEndStream, 1, []byte("short"))
+	rstStream(t, c, 1, ErrCodeProtocol)
+
+	// Test: HEADERS on a half-closed stream resets only that stream
+	release := make(chan struct{})
+	c = newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/wait" {
+			<-release
+		}
+		echoHandler(w, req)
+	})
+	defer close(release)
+	c.request(1, true, get("/wait")...)
+	c.request(1, true, get("/again")...)
+	rstStream(t, c, 1, ErrCodeStreamClosed)
+	// the block still went through the decoder, the table is in sync
+	c.request(3, true, get("/again")...)
+	assert.Equal(t, "/again ", c.responses(3)[3].body)
+
+	// Test: streams over the limit are refused
+	c = newTestClient(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	for id := uint32(1); id <= 9; id += 2 {
+		c.request(id, false, get("/")...)
+	}
+	rstStream(t, c, 9, ErrCodeRefusedStream)
+}
+
+func TestLimits(t *testing.T) {
+	rstStream := func(t *testing.T, c *testClient, id uint32, code ErrCode) {
+		f := c.read()
+		require.Equal(t, frameRSTStream, f.typ)
+		assert.Equal(t, id, f.streamID)
+		assert.Equal(t, code, ErrCode(binary.BigEndian.Uint32(f.payload)))
+	}
+	// readWindow returns the next WINDOW_UPDATE of a stream
+	readWindow := func(t *testing.T, c *testClient, id uint32) uint32 {
+		for {
+			f, err := readFrame(c.br, maxFrameSizeLimit)
+			require.NoError(t, err)
+			if f.typ == frameWindowUpdate && f.streamID == id {
+				return binary.BigEndian.Uint32(f.payload)
+			}
+		}
+	}
+
+	// Test: a header list over SETTINGS_MAX_HEADER_LIST_SIZE gets a 431, the connection goes on
+	c := newTestClient(t, echoHandler)
+	big := hpack.HeaderField{Name: "x-big", Value: strings.Repeat("v", 1000)}
+	fields := get("/")
+	// indexed after the first one, the block stays small
+	for i := 0; i < maxHeaderBlockSize/1000; i++ {
+		fields = append(fields, big)
+	}
+	block := c.encoder.Encode(nil, fields)
+	require.Less(t, len(block), defaultMaxFrameSize)
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, block)
+	r := c.responses(1)[1]
+	assert.Equal(t, "431", r.get(":status"))
+	c.request(3, true, get("/ok")...)
+	assert.Equal(t, "/ok ", c.responses(3)[3].body)
+
+	// Test: a declared body over the limit gets a 413 and the client is asked to stop
+	opts := Options{MaxConcurrentStreams: 4, MaxRequestBodySize: 10}
+	c = newTestClientWithOptions(t, echoHandler, opts)
+	c.request(1, false, append(get("/"), hpack.HeaderField{Name: "content-length", Value: "11"})...)
+	assert.Equal(t, "413", c.responses(1)[1].get(":status"))
+	rstStream(t, c, 1, ErrCodeNo)
+
+	// Test: so does a body without content-length that grows past it
+	c = newTestClientWithOptions(t, echoHandler, opts)
+	c.request(1, false, get("/")...)
+	c.write(frameData, 0, 1, []byte("0123456789x"))
+	assert.Equal(t, "413", c.responses(1)[1].get(":status"))
+	rstStream(t, c, 1, ErrCodeNo)
+	c.request(3, false, get("/post")...)
+	c.write(frameData, flagEndStream, 3, []byte("fits"))
+	assert.Equal(t, "/post fits", c.responses(3)[3].body)
+
+	// Test: the stream window is only given back while the body can still grow
+	opts.MaxRequestBodySize = defaultWindowSize + 100
+	c = newTestClientWithOptions(t, echoHandler, opts)
+	c.request(1, false, get("/")...)
+	c.write(frameData, 0, 1, make([]byte, 1000))
+	assert.Equal(t, uint32(101), readWindow(t, c, 1))
+	for sent := 0; sent < 64000; sent += 16000 {
+		c.write(frameData, 0, 1, make([]byte, 16000))
+	}
+
+	// Test: DATA beyond the window is a flow control error, padding counts too
+	c.write(frameData, flagPadded, 1, append([]byte{255}, make([]byte, 1000)...))
+	rstStream(t, c, 1, ErrCodeFlowControl)
+}
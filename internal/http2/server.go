@@ -0,0 +1,758 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+type Handler func(w *response.Writer, req *request.Request)
+
+type Options struct {
+	// ServerName is sent in the Server header, empty leaves it out
+	ServerName string
+	// MaxConcurrentStreams defaults to DefaultMaxConcurrentStreams
+	MaxConcurrentStreams uint32
+	// MaxRequestBodySize defaults to DefaultMaxRequestBodySize. Bodies are
+	// buffered whole before the handler runs, larger ones get a 413.
+	MaxRequestBodySize int64
+	// TLS is the state of the connection, copied to every request
+	TLS *tls.ConnectionState
+	// Upgrade is the HTTP/1.1 request that switched the connection with
+	// Upgrade: h2c, it is answered on stream 1. UpgradeSettings is its
+	// decoded HTTP2-Settings, in effect from the start. RFC 7540 3.2
+	Upgrade         *request.Request
+	UpgradeSettings []byte
+}
+
+const DefaultMaxConcurrentStreams = 100
+
+const DefaultMaxRequestBodySize = 10 << 20
+
+// header blocks are collected in memory before decoding, this keeps a
+// CONTINUATION flood from eating it all. It is our
+// SETTINGS_MAX_HEADER_LIST_SIZE as well, the decoded size of a block.
+const maxHeaderBlockSize = 64 << 10
+
+// maxEncoderTableSize caps the table a peer can make us keep per connection
+const maxEncoderTableSize = 64 << 10
+
+// SETTINGS identifiers, RFC 9113 6.5.2
+const (
+	settingHeaderTableSize      = 0x1
+	settingEnablePush           = 0x2
+	settingMaxConcurrentStreams = 0x3
+	settingInitialWindowSize    = 0x4
+	settingMaxFrameSize         = 0x5
+	settingMaxHeaderListSize    = 0x6
+)
+
+var ERROR_STREAM_CLOSED = fmt.Errorf("http2: stream closed")
+
+type serverConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	handler Handler
+	opts    Options
+
+	// only used by the read loop
+	decoder    *hpack.Decoder
+	continuing *headerBlock
+	recvWindow int64
+
+	// frames are written whole under writeMu, header blocks are encoded
+	// under it too so they reach the peer in encoding order
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+	encoder *hpack.Encoder
+
+	mu               sync.Mutex
+	cond             *sync.Cond // windows grew, a stream was reset or the conn closed
+	streams          map[uint32]*stream
+	lastStreamID     uint32
+	sendWindow       int64
+	peerInitialWin   int64
+	peerMaxFrameSize uint32
+	closed           bool
+	goAwaySent       bool
+
+	handlers sync.WaitGroup
+}
+
+// headerBlock is a HEADERS frame waiting for its CONTINUATION frames
+type headerBlock struct {
+	streamID  uint32
+	endStream bool
+	trailers  bool
+	// the client already ended the stream, RFC 9113 5.1 half-closed (remote)
+	halfClosed bool
+	block      []byte
+}
+
+// SniffPreface reads from r until the bytes either are the HTTP/2 client
+// preface or can't become it. The bytes read are returned so an HTTP/1.1
+// parser can be handed them again.
+func SniffPreface(r io.Reader) ([]byte, bool, error) {
+	buf := make([]byte, len(ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if !bytes.HasPrefix([]byte(ClientPreface), buf[:n]) {
+			return buf[:n], false, nil
+		}
+		if err != nil && n < len(buf) {
+			return buf[:n], false, err
+		}
+	}
+	return buf, true, nil
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away. conn must
+// start with the client preface. Handlers run in their own goroutine per
+// stream and ServeConn waits for them before returning.
+func ServeConn(conn net.Conn, handler Handler, opts Options) error {
+	if opts.MaxConcurrentStreams == 0 {
+		opts.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	if opts.MaxRequestBodySize == 0 {
+		opts.MaxRequestBodySize = DefaultMaxRequestBodySize
+	}
+	sc := &serverConn{
+		conn:             conn,
+		br:               bufio.NewReader(conn),
+		handler:          handler,
+		opts:             opts,
+		decoder:          hpack.NewDecoder(hpack.DefaultTableSize),
+		encoder:          hpack.NewEncoder(hpack.DefaultTableSize),
+		recvWindow:       defaultWindowSize,
+		bw:               bufio.NewWriter(conn),
+		streams:          map[uint32]*stream{},
+		sendWindow:       defaultWindowSize,
+		peerInitialWin:   defaultWindowSize,
+		peerMaxFrameSize: defaultMaxFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.decoder.SetMaxHeaderListSize(maxHeaderBlockSize)
+
+	err := sc.serve()
+
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	// handlers still writing fail fast on a closed connection
+	conn.Close()
+	sc.handlers.Wait()
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (sc *serverConn) serve() error {
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return sc.goAway(&ConnError{ErrCodeProtocol, "invalid connection preface"})
+	}
+
+	settings := []byte{}
+	for _, s := range [][2]uint32{
+		{settingMaxConcurrentStreams, sc.opts.MaxConcurrentStreams},
+		{settingMaxHeaderListSize, maxHeaderBlockSize},
+	} {
+		settings = binary.BigEndian.AppendUint16(settings, uint16(s[0]))
+		settings = binary.BigEndian.AppendUint32(settings, s[1])
+	}
+	if err := sc.writeFrame(frameSettings, 0, 0, settings); err != nil {
+		return err
+	}
+	if sc.opts.Upgrade != nil {
+		if err := sc.processUpgrade(); err != nil {
+			var ce *ConnError
+			if errors.As(err, &ce) {
+				return sc.goAway(ce)
+			}
+			return err
+		}
+	}
+
+	// the preface ends with the client's SETTINGS
+	first := true
+	for {
+		f, err := readFrame(sc.br, defaultMaxFrameSize)
+		if err == nil && first && (f.typ != frameSettings || f.has(flagAck)) {
+			err = connError(ErrCodeProtocol, "connection must start with SETTINGS")
+		}
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+		first = false
+
+		var se *StreamError
+		var ce *ConnError
+		switch {
+		case err == nil:
+		case errors.As(err, &se):
+			sc.resetStream(se.StreamID, se.Code)
+		case errors.As(err, &ce):
+			return sc.goAway(ce)
+		default:
+			return err
+		}
+	}
+}
+
+func (sc *serverConn) processFrame(f frame) error {
+	if sc.continuing != nil && (f.typ != frameContinuation || f.streamID != sc.continuing.streamID) {
+		return connError(ErrCodeProtocol, "expected CONTINUATION for stream %d", sc.continuing.streamID)
+	}
+
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case frameContinuation:
+		return sc.processContinuation(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.payload) != 5 {
+			return streamError(f.streamID, ErrCodeFrameSize, "PRIORITY of %d bytes", len(f.payload))
+		}
+		// priorities are only a hint, every stream is served as it comes
+		return nil
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return connError(ErrCodeProtocol, "clients can't push")
+	case framePing:
+		if f.streamID != 0 {
+			return connError(ErrCodeProtocol, "PING on stream %d", f.streamID)
+		}
+		if len(f.payload) != 8 {
+			return connError(ErrCodeFrameSize, "PING of %d bytes", len(f.payload))
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.streamID)
+		}
+		// streams in flight still finish, the client closes when it's done
+		return nil
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+	// unknown frame types are ignored, RFC 9113 5.5
+	return nil
+}
+
+func (sc *serverConn) processSettings(f frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.streamID)
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ack with a payload")
+		}
+		return nil
+	}
+	if len(f.payload)%6 != 0 {
+		return connError(ErrCodeFrameSize, "SETTINGS of %d bytes", len(f.payload))
+	}
+	if err := sc.applySettings(f.payload); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(payload []byte) error {
+	for p := payload; len(p) > 0; p = p[6:] {
+		id := binary.BigEndian.Uint16(p)
+		value := binary.BigEndian.Uint32(p[2:])
+		switch id {
+		case settingEnablePush:
+			if value > 1 {
+				return connError(ErrCodeProtocol, "ENABLE_PUSH of %d", value)
+			}
+		case settingInitialWindowSize:
+			if value > maxWindowSize {
+				return connError(ErrCodeFlowControl, "INITIAL_WINDOW_SIZE of %d", value)
+			}
+			if err := sc.setInitialWindow(int64(value)); err != nil {
+				return err
+			}
+		case settingMaxFrameSize:
+			if value < defaultMaxFrameSize || value > maxFrameSizeLimit {
+				return connError(ErrCodeProtocol, "MAX_FRAME_SIZE of %d", value)
+			}
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = value
+			sc.mu.Unlock()
+		case settingHeaderTableSize:
+			// the size update goes out with the next header block
+			sc.writeMu.Lock()
+			sc.encoder.SetMaxTableSize(int(min(value, maxEncoderTableSize)))
+			sc.writeMu.Unlock()
+		}
+	}
+	return nil
+}
+
+// setInitialWindow moves the send window of every open stream by the
+// difference, RFC 9113 6.9.2
+func (sc *serverConn) setInitialWindow(value int64) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delta := value - sc.peerInitialWin
+	sc.peerInitialWin = value
+	for _, st := range sc.streams {
+		st.sendWindow += delta
+		if st.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "window of stream %d overflows", st.id)
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE of %d bytes", len(f.payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & 0x7FFFFFFF)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window overflows")
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st := sc.streams[f.streamID]
+	if st == nil {
+		if f.streamID > sc.lastStreamID {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.streamID)
+		}
+		// the stream is done, the update crossed our END_STREAM
+		return nil
+	}
+	if increment == 0 {
+		return streamError(f.streamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError(f.streamID, ErrCodeFlowControl, "stream window overflows")
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM of %d bytes", len(f.payload))
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID > sc.lastStreamID {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.streamID)
+	}
+	if st := sc.streams[f.streamID]; st != nil {
+		st.reset = true
+		delete(sc.streams, f.streamID)
+		sc.cond.Broadcast()
+	}
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream 0")
+	}
+	payload, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(payload) < 5 {
+			return connError(ErrCodeFrameSize, "HEADERS too short for its priority")
+		}
+		payload = payload[5:]
+	}
+
+	hb := &headerBlock{streamID: f.streamID, endStream: f.has(flagEndStream)}
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	lastStreamID := sc.lastStreamID
+	if f.streamID > sc.lastStreamID {
+		sc.lastStreamID = f.streamID
+	}
+	sc.mu.Unlock()
+
+	switch {
+	case st != nil && !st.remoteClosed:
+		hb.trailers = true
+	case st != nil:
+		hb.halfClosed = true
+	case f.streamID%2 == 0:
+		return connError(ErrCodeProtocol, "client opened even stream %d", f.streamID)
+	case f.streamID <= lastStreamID:
+		// a stream id can't be used twice
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", f.streamID)
+	}
+
+	hb.block = append(hb.block, payload...)
+	if !f.has(flagEndHeaders) {
+		sc.continuing = hb
+		return nil
+	}
+	return sc.processHeaderBlock(hb)
+}
+
+func (sc *serverConn) processContinuation(f frame) error {
+	hb := sc.continuing
+	if hb == nil {
+		return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+	}
+	if len(hb.block)+len(f.payload) > maxHeaderBlockSize {
+		return connError(ErrCodeEnhanceYourCalm, "header block over %d bytes", maxHeaderBlockSize)
+	}
+	hb.block = append(hb.block, f.payload...)
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	sc.continuing = nil
+	return sc.processHeaderBlock(hb)
+}
+
+func (sc *serverConn) processHeaderBlock(hb *headerBlock) error {
+	// decode even if the stream is refused, the table must stay in sync
+	fields, err := sc.decoder.Decode(hb.block)
+	if hb.halfClosed && (err == nil || errors.Is(err, hpack.ERROR_HEADER_LIST_TOO_LARGE)) {
+		return streamError(hb.streamID, ErrCodeStreamClosed, "HEADERS on half-closed stream")
+	}
+	if errors.Is(err, hpack.ERROR_HEADER_LIST_TOO_LARGE) {
+		// the table is still in sync, only this request is refused
+		sc.mu.Lock()
+		st := sc.streams[hb.streamID]
+		sc.mu.Unlock()
+		if hb.trailers && st == nil {
+			return nil
+		}
+		return sc.refuse(hb.streamID, response.StatusHeaderFieldsTooLarge, hb.endStream)
+	}
+	if err != nil {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	if hb.trailers {
+		if !hb.endStream {
+			return streamError(hb.streamID, ErrCodeProtocol, "trailers without END_STREAM")
+		}
+		// trailers are accepted but the request has no place for them
+		sc.mu.Lock()
+		st := sc.streams[hb.streamID]
+		sc.mu.Unlock()
+		if st == nil {
+			return nil
+		}
+		return sc.endOfRequest(st)
+	}
+
+	req, err := newRequest(hb.streamID, fields)
+	if err != nil {
+		return err
+	}
+	req.TLS = sc.opts.TLS
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	declared := contentLength(req)
+	if declared > sc.opts.MaxRequestBodySize {
+		return sc.refuse(hb.streamID, response.StatusRequestEntityTooLarge, hb.endStream)
+	}
+
+	sc.mu.Lock()
+	if sc.goAwaySent || uint32(len(sc.streams)) >= sc.opts.MaxConcurrentStreams {
+		sc.mu.Unlock()
+		return streamError(hb.streamID, ErrCodeRefusedStream, "too many streams")
+	}
+	st := &stream{
+		sc:         sc,
+		id:         hb.streamID,
+		req:        req,
+		declared:   declared,
+		sendWindow: sc.peerInitialWin,
+		recvWindow: defaultWindowSize,
+	}
+	sc.streams[st.id] = st
+	sc.mu.Unlock()
+
+	if hb.endStream {
+		return sc.endOfRequest(st)
+	}
+	return nil
+}
+
+// processUpgrade turns the request of an h2c upgrade into stream 1, which
+// starts out half closed since the request came whole. HTTP2-Settings
+// are never acknowledged.
+func (sc *serverConn) processUpgrade() error {
+	if len(sc.opts.UpgradeSettings)%6 != 0 {
+		return connError(ErrCodeProtocol, "HTTP2-Settings of %d bytes", len(sc.opts.UpgradeSettings))
+	}
+	if err := sc.applySettings(sc.opts.UpgradeSettings); err != nil {
+		return err
+	}
+
+	req := sc.opts.Upgrade
+	// these were about the HTTP/1.1 connection that is gone now
+	for _, name := range []string{"connection", "upgrade", "http2-settings"} {
+		req.Headers.Delete(name)
+	}
+	// the response goes out as HTTP/2 like every other stream's
+	req.RequestLine.HttpVersion = "2"
+	req.TLS = sc.opts.TLS
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+
+	sc.mu.Lock()
+	st := &stream{
+		sc:         sc,
+		id:         1,
+		req:        req,
+		declared:   -1,
+		sendWindow: sc.peerInitialWin,
+	}
+	sc.streams[st.id] = st
+	sc.lastStreamID = st.id
+	sc.mu.Unlock()
+	return sc.endOfRequest(st)
+}
+
+func (sc *serverConn) processData(f frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	// padding counts against flow control too
+	length := int64(len(f.payload))
+	if length > sc.recvWindow {
+		return connError(ErrCodeFlowControl, "DATA over the connection window")
+	}
+	sc.recvWindow -= length
+	if length > 0 {
+		// bodies are buffered whole, so the window is given back right away
+		if err := sc.writeWindowUpdate(0, length); err != nil {
+			return err
+		}
+		sc.recvWindow += length
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+	if st == nil || st.remoteClosed {
+		if f.streamID > lastStreamID {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", f.streamID)
+		}
+		return streamError(f.streamID, ErrCodeStreamClosed, "DATA on closed stream")
+	}
+	if length > st.recvWindow {
+		return streamError(f.streamID, ErrCodeFlowControl, "DATA over the stream window")
+	}
+	st.recvWindow -= length
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	st.req.Body = append(st.req.Body, data...)
+	if st.declared >= 0 && int64(len(st.req.Body)) > st.declared {
+		return streamError(f.streamID, ErrCodeProtocol, "body longer than content-length")
+	}
+	if int64(len(st.req.Body)) > sc.opts.MaxRequestBodySize {
+		return sc.refuse(st.id, response.StatusRequestEntityTooLarge, f.has(flagEndStream))
+	}
+
+	if f.has(flagEndStream) {
+		return sc.endOfRequest(st)
+	}
+	// the window only opens as far as the body may still grow, plus one
+	// byte so a body without content-length runs into the 413, not a stall
+	room := sc.opts.MaxRequestBodySize + 1 - int64(len(st.req.Body))
+	if grow := min(defaultWindowSize, room) - st.recvWindow; grow > 0 {
+		if err := sc.writeWindowUpdate(st.id, grow); err != nil {
+			return err
+		}
+		st.recvWindow += grow
+	}
+	return nil
+}
+
+// endOfRequest runs the handler once the client has sent everything
+func (sc *serverConn) endOfRequest(st *stream) error {
+	st.remoteClosed = true
+	if st.declared >= 0 && int64(len(st.req.Body)) != st.declared {
+		return streamError(st.id, ErrCodeProtocol, "body shorter than content-length")
+	}
+	sc.handlers.Add(1)
+	go sc.runHandler(st)
+	return nil
+}
+
+func (sc *serverConn) runHandler(st *stream) {
+	defer sc.handlers.Done()
+
+	w := response.NewStreamWriter(st, response.DefaultBufferSize)
+	w.SetServerName(sc.opts.ServerName)
+	// HEAD is served by the GET code path, the writer drops the body
+	if st.req.HeadAsGet() {
+		w.DiscardBody()
+	}
+	sc.handler(w, st.req)
+
+	err := w.Finish()
+	sc.mu.Lock()
+	ended := st.ended
+	sc.mu.Unlock()
+	if err != nil || !ended {
+		// a half sent response can't be fixed up, tell the client
+		if err != nil {
+			fmt.Println("response error: ", err)
+		}
+		sc.resetStream(st.id, ErrCodeInternal)
+		return
+	}
+	sc.closeStream(st)
+}
+
+// refuse answers a request with an empty response of status without
+// running the handler. A client still sending the body is asked to stop
+// with RST_STREAM NO_ERROR, RFC 9113 8.1.
+func (sc *serverConn) refuse(id uint32, status response.StatusCode, remoteClosed bool) error {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(status))}, {Name: "content-length", Value: "0"}}
+	if err := sc.writeHeaders(&stream{id: id}, fields, true); err != nil {
+		return err
+	}
+	if !remoteClosed {
+		sc.resetStream(id, ErrCodeNo)
+		return nil
+	}
+	sc.mu.Lock()
+	delete(sc.streams, id)
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.streams[st.id] == st {
+		delete(sc.streams, st.id)
+	}
+}
+
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		st.reset = true
+		delete(sc.streams, id)
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// goAway tells the client which streams were processed and why the
+// connection ends, then returns the error
+func (sc *serverConn) goAway(ce *ConnError) error {
+	sc.mu.Lock()
+	sc.goAwaySent = true
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(ce.Code))
+	payload = append(payload, ce.Reason...)
+	sc.writeFrame(frameGoAway, 0, 0, payload)
+	return ce
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment int64) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	b := appendFrameHeader(nil, typ, flags, streamID, len(payload))
+	if _, err := sc.bw.Write(append(b, payload...)); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+// writeHeaders encodes fields and sends them as HEADERS plus as many
+// CONTINUATION frames as the peer's frame size needs
+func (sc *serverConn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	maxFrameSize := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := sc.encoder.Encode(nil, fields)
+
+	typ := frameHeaders
+	var flags uint8
+	if endStream {
+		flags = flagEndStream
+	}
+	for {
+		n := min(len(block), maxFrameSize)
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		if _, err := sc.bw.Write(appendFrameHeader(nil, typ, flags, st.id, n)); err != nil {
+			return err
+		}
+		if _, err := sc.bw.Write(block[:n]); err != nil {
+			return err
+		}
+		block = block[n:]
+		if len(block) == 0 {
+			return sc.bw.Flush()
+		}
+		typ, flags = frameContinuation, 0
+	}
+}
@@ -0,0 +1,194 @@
+package http2
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+)
+
+type stream struct {
+	sc  *serverConn
+	id  uint32
+	req *request.Request
+	// Content-Length of the request, -1 if there is none
+	declared int64
+
+	// read loop only
+	remoteClosed bool
+	recvWindow   int64
+
+	// guarded by sc.mu
+	sendWindow int64
+	reset      bool
+	ended      bool
+}
+
+// request headers that are only about one HTTP/1.1 connection,
+// RFC 9113 8.2.2
+var connectionSpecific = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// newRequest checks the decoded fields of a request (RFC 9113 8.3.1) and
+// maps them onto a request.Request
+func newRequest(streamID uint32, fields []hpack.HeaderField) (*request.Request, error) {
+	pseudo := map[string]string{}
+	regular := false
+
+	for _, f := range fields {
+		if strings.ToLower(f.Name) != f.Name {
+			return nil, streamError(streamID, ErrCodeProtocol, "uppercase field name %q", f.Name)
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			switch f.Name {
+			case ":method", ":scheme", ":path", ":authority":
+			default:
+				return nil, streamError(streamID, ErrCodeProtocol, "unknown pseudo-header %s", f.Name)
+			}
+			if _, dup := pseudo[f.Name]; dup || regular {
+				return nil, streamError(streamID, ErrCodeProtocol, "misplaced pseudo-header %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		regular = true
+		if connectionSpecific[f.Name] || f.Name == "te" && f.Value != "trailers" {
+			return nil, streamError(streamID, ErrCodeProtocol, "connection-specific field %s", f.Name)
+		}
+	}
+	h := hpack.ToHeaders(fields)
+
+	method := pseudo[":method"]
+	path := pseudo[":path"]
+	authority, hasAuthority := pseudo[":authority"]
+	if method == "CONNECT" {
+		_, hasScheme := pseudo[":scheme"]
+		_, hasPath := pseudo[":path"]
+		if !hasAuthority || hasScheme || hasPath {
+			return nil, streamError(streamID, ErrCodeProtocol, "malformed CONNECT request")
+		}
+		path = authority
+	} else if method == "" || path == "" || pseudo[":scheme"] == "" {
+		return nil, streamError(streamID, ErrCodeProtocol, "missing pseudo-header")
+	}
+	// handlers look at Host like they do for HTTP/1.1
+	if _, ok := h.Get("host"); !ok && hasAuthority {
+		h.Set("Host", authority)
+	}
+	return request.NewRequest(method, path, "2", h, nil), nil
+}
+
+func contentLength(req *request.Request) int64 {
+	value, ok := req.Headers.Get("content-length")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// responseFields turns a status and headers into a field list
+func responseFields(status response.StatusCode, h *headers.Headers) []hpack.HeaderField {
+	return append([]hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(status))}}, hpack.FromHeaders(h)...)
+}
+
+// WriteHead implements response.Stream
+func (st *stream) WriteHead(status response.StatusCode, h *headers.Headers, endStream bool) error {
+	if err := st.check(); err != nil {
+		return err
+	}
+	if err := st.sc.writeHeaders(st, responseFields(status, h), endStream); err != nil {
+		return err
+	}
+	if endStream {
+		st.markEnded()
+	}
+	return nil
+}
+
+// Write sends DATA frames as the flow control windows allow
+func (st *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := st.sc.reserveWindow(st, len(p))
+		if err != nil {
+			return written, err
+		}
+		if err := st.sc.writeFrame(frameData, 0, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream with an empty DATA frame or with trailers
+func (st *stream) Close(trailers *headers.Headers) error {
+	st.sc.mu.Lock()
+	ended := st.ended
+	st.sc.mu.Unlock()
+	if ended {
+		return nil
+	}
+	if err := st.check(); err != nil {
+		return err
+	}
+
+	var err error
+	if trailers != nil {
+		fields := responseFields(0, trailers)[1:]
+		err = st.sc.writeHeaders(st, fields, true)
+	} else {
+		err = st.sc.writeFrame(frameData, flagEndStream, st.id, nil)
+	}
+	if err != nil {
+		return err
+	}
+	st.markEnded()
+	return nil
+}
+
+func (st *stream) check() error {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	if st.reset || st.ended || st.sc.closed {
+		return ERROR_STREAM_CLOSED
+	}
+	return nil
+}
+
+func (st *stream) markEnded() {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	st.ended = true
+}
+
+// reserveWindow waits until both the stream and the connection window
+// have room and takes up to want bytes (at most one frame) from them
+func (sc *serverConn) reserveWindow(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.reset || st.ended || sc.closed {
+			return 0, ERROR_STREAM_CLOSED
+		}
+		if window := min(st.sendWindow, sc.sendWindow); window > 0 {
+			n := min(int64(want), window, int64(sc.peerMaxFrameSize))
+			st.sendWindow -= n
+			sc.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
@@ -0,0 +1,275 @@
+// Package proxy forwards requests to an upstream server and streams the
+// answer back, a reverse proxy in the shape of a server.Handler
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is how long the upstream has to start its response
+const DefaultTimeout = 30 * time.Second
+
+type Options struct {
+	// Client makes the upstream requests and keeps their connections
+	// alive, client.DefaultClient if nil
+	Client *client.Client
+	// Timeout is how long the upstream has to send its response headers,
+	// DefaultTimeout if zero. The body may stream for as long as it takes.
+	Timeout time.Duration
+	// StripPrefix is cut from the request path before it is joined to the
+	// target's path
+	StripPrefix string
+	// PreserveHost sends the client's Host instead of the target's
+	PreserveHost bool
+}
+
+var DefaultOptions = Options{
+	Timeout: DefaultTimeout,
+}
+
+// fields about a single connection, never forwarded (RFC 9110 7.6.1)
+var hopByHop = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// Handler forwards every request to target with DefaultOptions
+func Handler(target *url.URL) server.Handler {
+	return HandlerWithOptions(target, DefaultOptions)
+}
+
+// HandlerWithOptions forwards every request to target and copies the
+// status, headers, body and trailers of the answer back. An upstream that
+// can't be reached gets a 502, one that doesn't answer in time a 504.
+func HandlerWithOptions(target *url.URL, opts Options) server.Handler {
+	upstream := opts.Client
+	if upstream == nil {
+		upstream = client.DefaultClient
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		method, rawURL, h, err := outboundRequest(target, req, opts)
+		if err != nil {
+			w.WriteProblem(response.Problem{Status: response.StatusBadRequest, Detail: err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		timer := time.AfterFunc(opts.Timeout, cancel)
+		res, err := upstream.Do(ctx, method, rawURL, h, req.Body)
+		timedOut := !timer.Stop()
+		if err != nil {
+			// the error names upstream addresses, it goes to the log only
+			fmt.Println("proxy error: ", err)
+			problem := response.Problem{Status: response.StatusBadGateway, Detail: "upstream unavailable"}
+			var netErr net.Error
+			if timedOut || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+				problem = response.Problem{Status: response.StatusGatewayTimeout, Detail: "upstream timed out"}
+			}
+			w.WriteProblem(problem)
+			return
+		}
+		defer res.Body.Close()
+
+		if err := copyResponse(w, res); err != nil {
+			// the status is out already, a clean end of the body would pass
+			// the truncated response off as complete, so cut the connection
+			fmt.Println("proxy error: ", err)
+			w.Abort()
+		}
+	}
+}
+
+// removeHopByHop deletes the hop-by-hop fields and the ones Connection
+// names
+func removeHopByHop(h *headers.Headers) {
+	connection, _ := h.Get("connection")
+	for _, name := range strings.Split(connection, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Delete(name)
+		}
+	}
+	for _, name := range hopByHop {
+		h.Delete(name)
+	}
+}
+
+// outboundRequest works out what to send upstream for req
+func outboundRequest(target *url.URL, req *request.Request, opts Options) (string, string, *headers.Headers, error) {
+	in, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid request target: %w", err)
+	}
+	out := *target
+	out.Path = joinPath(target.Path, strings.TrimPrefix(in.Path, opts.StripPrefix))
+	out.RawPath = ""
+	out.RawQuery = target.RawQuery
+	if in.RawQuery != "" {
+		if out.RawQuery != "" {
+			out.RawQuery += "&"
+		}
+		out.RawQuery += in.RawQuery
+	}
+
+	// HEAD was rewritten to GET for the handler, upstream gets the real one
+	method := req.RequestLine.Method
+	if req.IsHead() {
+		method = "HEAD"
+	}
+
+	h := req.Headers.Clone()
+	removeHopByHop(h)
+	host, _ := h.Get("host")
+	// the client sets the target's Host unless we keep the client's
+	if !opts.PreserveHost {
+		h.Delete("host")
+	}
+	setForwarded(h, req, host)
+	return method, out.String(), h, nil
+}
+
+// joinPath puts the target's path in front of the request's with exactly
+// one slash between them
+func joinPath(base, path string) string {
+	switch {
+	case base == "" || base == "/":
+		if !strings.HasPrefix(path, "/") {
+			return "/" + path
+		}
+		return path
+	case path == "" || path == "/":
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// setForwarded adds this hop to Forwarded (RFC 7239) and the
+// X-Forwarded-* fields most upstreams still look at instead
+func setForwarded(h *headers.Headers, req *request.Request, host string) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	var element []string
+	if ip != "" {
+		node := ip
+		// IPv6 addresses are bracketed and quoted, RFC 7239 6
+		if strings.Contains(ip, ":") {
+			node = `"[` + ip + `]"`
+		}
+		element = append(element, "for="+node)
+		if prior, _ := h.Get("x-forwarded-for"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		h.Set("X-Forwarded-For", ip)
+	}
+	if host != "" {
+		element = append(element, "host="+forwardedValue(host))
+		h.Set("X-Forwarded-Host", host)
+	}
+	element = append(element, "proto="+proto)
+	h.Set("X-Forwarded-Proto", proto)
+
+	forwarded := strings.Join(element, ";")
+	if prior, _ := h.Get("forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Set("Forwarded", forwarded)
+}
+
+// forwardedValue writes v as a token, or as a quoted-string when it isn't
+// one, e.g. host:port. RFC 7239 4
+func forwardedValue(v string) string {
+	isToken := v != "" && !strings.ContainsFunc(v, func(c rune) bool {
+		return c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+	})
+	if isToken {
+		return v
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range []byte(v) {
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// copyResponse streams the upstream response to the client. Trailers the
+// upstream announced are announced again and sent after the body.
+func copyResponse(w *response.Writer, res *client.Response) error {
+	h := res.Headers.Clone()
+	announced, _ := h.Get("trailer")
+	removeHopByHop(h)
+
+	var trailerNames []string
+	for _, name := range strings.Split(announced, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			trailerNames = append(trailerNames, name)
+		}
+	}
+	if len(trailerNames) > 0 {
+		sort.Strings(trailerNames)
+		h.Set("Trailer", strings.Join(trailerNames, ", "))
+		// trailers need a chunked body
+		h.Delete("content-length")
+	}
+
+	if err := w.WriteStatusLine(res.StatusLine.StatusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+	// the headers go out now, the body follows as the upstream sends it
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return err
+	}
+
+	if len(trailerNames) > 0 {
+		// only what was announced, the writer refuses anything else
+		trailers := headers.NewHeaders()
+		for _, name := range trailerNames {
+			if v, ok := res.Trailers.Get(name); ok {
+				trailers.Set(name, v)
+			}
+		}
+		return w.WriteTrailers(*trailers)
+	}
+	return nil
+}
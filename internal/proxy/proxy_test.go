@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve starts one of our servers and returns its base URL
+func serve(t *testing.T, handler server.Handler) *url.URL {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	u, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	return u
+}
+
+// echo answers with what it received, headers as X-Got-* fields
+func echo(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(0)
+	h.Delete("content-length")
+	req.Headers.ForEach(func(n, v string) {
+		h.Set("X-Got-"+n, v)
+	})
+	method := req.RequestLine.Method
+	if req.IsHead() {
+		method = "HEAD"
+	}
+	h.Set("X-Method", method)
+	h.Set("X-Target", req.RequestLine.RequestTarget)
+	h.Set("Connection", "X-Upstream-Only")
+	h.Set("X-Upstream-Only", "1")
+	w.WriteStatusLine(response.StatusCreated)
+	w.WriteHeaders(*h)
+	w.WriteBody(req.Body)
+}
+
+func TestProxy(t *testing.T) {
+	upstream := serve(t, echo)
+	upstream.Path = "/api"
+	front := serve(t, HandlerWithOptions(upstream, Options{StripPrefix: "/proxy"}))
+
+	// Test: method, path, query, headers and body reach the upstream
+	req, err := http.NewRequest("PUT", front.String()+"/proxy/items?id=7", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("X-Custom", "value")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "secret")
+	req.Header.Set("Forwarded", "for=192.0.2.1")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "payload", string(body))
+	assert.Equal(t, "PUT", res.Header.Get("X-Method"))
+	assert.Equal(t, "/api/items?id=7", res.Header.Get("X-Target"))
+	assert.Equal(t, "value", res.Header.Get("X-Got-X-Custom"))
+	assert.Equal(t, upstream.Host, res.Header.Get("X-Got-Host"))
+
+	// Test: hop-by-hop fields are dropped both ways
+	assert.Empty(t, res.Header.Get("X-Got-X-Hop"))
+	assert.Empty(t, res.Header.Get("X-Upstream-Only"))
+
+	// Test: this hop is appended to Forwarded and X-Forwarded-*
+	forwarded := `for=192.0.2.1, for=127.0.0.1;host="` + front.Host + `";proto=http`
+	assert.Equal(t, forwarded, res.Header.Get("X-Got-Forwarded"))
+	assert.Equal(t, "127.0.0.1", res.Header.Get("X-Got-X-Forwarded-For"))
+	assert.Equal(t, front.Host, res.Header.Get("X-Got-X-Forwarded-Host"))
+	assert.Equal(t, "http", res.Header.Get("X-Got-X-Forwarded-Proto"))
+
+	// Test: HEAD stays HEAD upstream
+	res, err = http.Head(front.String() + "/proxy/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "HEAD", res.Header.Get("X-Method"))
+}
+
+func TestProxyStreaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("content-length")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteChunkedBody([]byte("first "))
+		w.Flush()
+		<-release
+		w.WriteChunkedBody([]byte("second"))
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(*trailers)
+	})
+	front := serve(t, Handler(upstream))
+
+	// Test: the first chunk arrives before the upstream has finished
+	res, err := http.Get(front.String() + "/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	first := make([]byte, len("first "))
+	_, err = io.ReadFull(res.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first ", string(first))
+	close(release)
+
+	// Test: trailers are passed through
+	rest, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(rest))
+	assert.Equal(t, "abc", res.Trailer.Get("X-Checksum"))
+}
+
+func TestProxyErrors(t *testing.T) {
+	// Test: nothing listening upstream is a 502
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed, _ := url.Parse("http://" + l.Addr().String())
+	l.Close()
+	front := serve(t, Handler(closed))
+	res, err := http.Get(front.String() + "/")
+	require.NoError(t, err)
+	problem, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	// Test: the client learns nothing about the upstream's address
+	assert.Contains(t, string(problem), "upstream unavailable")
+	assert.NotContains(t, string(problem), closed.Host)
+
+	// Test: an upstream slower than the timeout is a 504
+	slow := serve(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(0))
+	})
+	front = serve(t, HandlerWithOptions(slow, Options{Timeout: 50 * time.Millisecond}))
+	res, err = http.Get(front.String() + "/")
+	require.NoError(t, err)
+	problem, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+	assert.Contains(t, string(problem), "upstream timed out")
+
+	// Test: an upstream failing mid-body fails the client's body too
+	broken := serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("content-length")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteChunkedBody([]byte("partial "))
+		w.Flush()
+		w.Abort()
+	})
+	front = serve(t, Handler(broken))
+	res, err = http.Get(front.String() + "/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "partial ", string(body))
+}
+
+func TestForwardedValue(t *testing.T) {
+	// Test: tokens stay bare
+	assert.Equal(t, "example.com", forwardedValue("example.com"))
+
+	// Test: anything else is a quoted-string, only " and \ are escaped
+	assert.Equal(t, `"example.com:8080"`, forwardedValue("example.com:8080"))
+	assert.Equal(t, `"a\"b\\c"`, forwardedValue(`a"b\c`))
+	assert.Equal(t, `"bücher.example"`, forwardedValue("bücher.example"))
+	assert.Equal(t, `""`, forwardedValue(""))
+}
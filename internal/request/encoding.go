@@ -0,0 +1,84 @@
+package request
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ERROR_MALFORMED_BODY = fmt.Errorf("malformed encoded body")
+
+// SupportedEncodings lists the content-codings DecodeBody understands.
+// x-gzip is the old name of gzip, RFC 9110 8.4.1.3.
+var SupportedEncodings = []string{"gzip", "x-gzip", "deflate"}
+
+var decoders = map[string]func(r io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": zlib.NewReader,
+}
+
+// DecodeBody undoes the Content-Encoding of the body in place.
+// Decoding stops with ERROR_BODY_TOO_LARGE once the output would go over
+// maxSize bytes, so a small zip bomb can't blow up memory.
+// On success Content-Encoding is removed and Content-Length updated.
+func (r *Request) DecodeBody(maxSize int) error {
+	value, ok := r.Headers.Get("content-encoding")
+	if !ok {
+		return nil
+	}
+
+	// codings are listed in the order they were applied
+	var encodings []string
+	for _, e := range strings.Split(value, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || e == "identity" {
+			continue
+		}
+		if _, ok := decoders[e]; !ok {
+			return fmt.Errorf("%w: content-encoding %q", ERROR_UNSUPPORTED_MEDIA_TYPE, e)
+		}
+		encodings = append(encodings, e)
+	}
+
+	body := r.Body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoded, err := decode(encodings[i], body, maxSize)
+		if err != nil {
+			return err
+		}
+		body = decoded
+	}
+
+	r.Body = body
+	r.Headers.Delete("content-encoding")
+	r.Headers.Set("content-length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func decode(encoding string, body []byte, maxSize int) ([]byte, error) {
+	decoder, err := decoders[encoding](bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ERROR_MALFORMED_BODY, err)
+	}
+	defer decoder.Close()
+
+	// read one byte past the cap to tell "exactly maxSize" from "more"
+	var out bytes.Buffer
+	n, err := io.Copy(&out, io.LimitReader(decoder, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ERROR_MALFORMED_BODY, err)
+	}
+	if n > int64(maxSize) {
+		return nil, fmt.Errorf("%w: decoded body is over %d bytes", ERROR_BODY_TOO_LARGE, maxSize)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,145 @@
+package request
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+var ERROR_NOT_MULTIPART = fmt.Errorf("request content-type is not multipart/form-data")
+
+// default memory limit for ParseMultipartForm when the caller passes <= 0
+const defaultMaxMemory = 32 << 20
+
+// splits the request target into path and raw query
+func (r *Request) splitTarget() (string, string) {
+	target := r.RequestLine.RequestTarget
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return target, ""
+}
+
+// Path returns the request target without the query string
+func (r *Request) Path() string {
+	path, _ := r.splitTarget()
+	return path
+}
+
+// Query returns the parsed query string of the request target
+func (r *Request) Query() url.Values {
+	_, rawQuery := r.splitTarget()
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return url.Values{}
+	}
+	return values
+}
+
+func (r *Request) mediaType() (string, map[string]string) {
+	contentType, ok := r.Headers.Get("content-type")
+	if !ok {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// ParseForm fills r.Form with the query string values and, for
+// application/x-www-form-urlencoded bodies, r.PostForm with the body values.
+// Body values come first in r.Form, like net/http does it.
+// Calling it more than once is a no-op.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+
+	r.PostForm = url.Values{}
+	mediaType, _ := r.mediaType()
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(r.Body))
+		if err != nil {
+			return fmt.Errorf("invalid form body: %w", err)
+		}
+		r.PostForm = values
+	}
+
+	_, rawQuery := r.splitTarget()
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return fmt.Errorf("invalid query string: %w", err)
+	}
+
+	r.Form = url.Values{}
+	for k, vs := range r.PostForm {
+		r.Form[k] = append(r.Form[k], vs...)
+	}
+	for k, vs := range query {
+		r.Form[k] = append(r.Form[k], vs...)
+	}
+	return nil
+}
+
+// FormValue returns the first value for key, parsing the form if needed.
+// Multipart forms are parsed too when the body is multipart/form-data.
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		if mediaType, _ := r.mediaType(); mediaType == "multipart/form-data" {
+			r.ParseMultipartForm(defaultMaxMemory)
+		} else {
+			r.ParseForm()
+		}
+	}
+	return r.Form.Get(key)
+}
+
+// MultipartReader returns a streaming reader over the parts of a
+// multipart/form-data body
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	mediaType, params := r.mediaType()
+	if mediaType != "multipart/form-data" {
+		return nil, ERROR_NOT_MULTIPART
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("multipart/form-data without boundary")
+	}
+	return NewMultipartReader(r.bodyReader(), boundary), nil
+}
+
+// ParseMultipartForm reads every part of a multipart/form-data body.
+// Plain fields go into r.Form and r.PostForm, files into r.MultipartForm.
+// File parts bigger than maxMemory are spilled to temp files; call
+// r.MultipartForm.RemoveAll() once done with them.
+func (r *Request) ParseMultipartForm(maxMemory int64) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if maxMemory <= 0 {
+		maxMemory = defaultMaxMemory
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	form, err := mr.ReadForm(maxMemory)
+	if err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		form.RemoveAll()
+		return err
+	}
+	for k, vs := range form.Value {
+		r.Form[k] = append(r.Form[k], vs...)
+		r.PostForm[k] = append(r.PostForm[k], vs...)
+	}
+	r.MultipartForm = form
+	return nil
+}
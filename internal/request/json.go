@@ -0,0 +1,60 @@
+package request
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ERROR_UNSUPPORTED_MEDIA_TYPE = fmt.Errorf("unsupported media type")
+var ERROR_BODY_TOO_LARGE = fmt.Errorf("request body too large")
+var ERROR_INVALID_JSON = fmt.Errorf("invalid json body")
+
+type JSONOptions struct {
+	// MaxBytes is the largest body DecodeJSON accepts (<= 0 means no limit)
+	MaxBytes int
+	// AllowUnknownFields turns off the strict field check
+	AllowUnknownFields bool
+}
+
+var DefaultJSONOptions = JSONOptions{
+	MaxBytes: 1 << 20,
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// DecodeJSON unmarshals the body into v using DefaultJSONOptions
+func (r *Request) DecodeJSON(v any) error {
+	return r.DecodeJSONWithOptions(v, DefaultJSONOptions)
+}
+
+// DecodeJSONWithOptions checks the Content-Type, the body size and then
+// decodes exactly one JSON value into v.
+// Unknown object fields are an error unless opts.AllowUnknownFields is set.
+func (r *Request) DecodeJSONWithOptions(v any, opts JSONOptions) error {
+	mediaType, _ := r.mediaType()
+	if !isJSONMediaType(mediaType) {
+		return fmt.Errorf("%w: expected application/json, got %q", ERROR_UNSUPPORTED_MEDIA_TYPE, mediaType)
+	}
+	if opts.MaxBytes > 0 && len(r.Body) > opts.MaxBytes {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ERROR_BODY_TOO_LARGE, len(r.Body), opts.MaxBytes)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(r.Body))
+	if !opts.AllowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ERROR_INVALID_JSON, err)
+	}
+
+	// only a single value is allowed in the body
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("%w: unexpected data after json value", ERROR_INVALID_JSON)
+	}
+	return nil
+}
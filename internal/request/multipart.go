@@ -0,0 +1,319 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"mime"
+	"os"
+	"strings"
+)
+
+var ERROR_MULTIPART_HEADERS_TOO_LARGE = fmt.Errorf("multipart part headers too large")
+
+const multipartBufSize = 4096
+
+func (r *Request) bodyReader() io.Reader {
+	return bytes.NewReader(r.Body)
+}
+
+// MultipartReader reads the parts of a multipart body one at a time,
+// without holding the whole body in memory
+type MultipartReader struct {
+	br       *bufio.Reader
+	dashed   []byte // "--boundary"
+	nlDashed []byte // "\r\n--boundary"
+	current  *Part
+	started  bool
+	finished bool
+}
+
+func NewMultipartReader(reader io.Reader, boundary string) *MultipartReader {
+	dashed := []byte("--" + boundary)
+	return &MultipartReader{
+		br:       bufio.NewReaderSize(reader, multipartBufSize),
+		dashed:   dashed,
+		nlDashed: append([]byte("\r\n"), dashed...),
+	}
+}
+
+// Part is a single part of a multipart body. Reading it yields the part
+// content up to the next boundary.
+type Part struct {
+	Header *headers.Headers
+
+	mr          *MultipartReader
+	eof         bool
+	disposition string
+	dispParams  map[string]string
+}
+
+// NextPart returns the next part or io.EOF after the closing boundary.
+// Any unread data of the previous part is discarded.
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.finished {
+		return nil, io.EOF
+	}
+	if mr.current != nil {
+		if _, err := io.Copy(io.Discard, mr.current); err != nil {
+			return nil, err
+		}
+		mr.current = nil
+	}
+
+	if !mr.started {
+		// skip the preamble until the first boundary line
+		for {
+			line, err := mr.br.ReadString('\n')
+			if err != nil {
+				if err == io.EOF {
+					return nil, io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			line = strings.TrimRight(line, " \t\r\n")
+			if line == string(mr.dashed) {
+				break
+			}
+			if line == string(mr.dashed)+"--" {
+				mr.finished = true
+				return nil, io.EOF
+			}
+		}
+		mr.started = true
+	} else {
+		// the previous part stopped right before "\r\n--boundary"
+		if _, err := mr.br.Discard(len(mr.nlDashed)); err != nil {
+			return nil, err
+		}
+		rest, err := mr.br.ReadString('\n')
+		if err != nil && !(err == io.EOF && strings.HasPrefix(rest, "--")) {
+			return nil, fmt.Errorf("malformed multipart boundary: %w", err)
+		}
+		if strings.HasPrefix(rest, "--") {
+			mr.finished = true
+			return nil, io.EOF
+		}
+		if strings.TrimRight(rest, " \t\r\n") != "" {
+			return nil, fmt.Errorf("malformed multipart boundary")
+		}
+	}
+
+	h, err := mr.readPartHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	part := &Part{Header: h, mr: mr}
+	if cd, ok := h.Get("content-disposition"); ok {
+		part.disposition, part.dispParams, _ = mime.ParseMediaType(cd)
+	}
+	mr.current = part
+	return part, nil
+}
+
+// part headers use the same field-line syntax as request headers,
+// so we feed them through headers.Parse
+func (mr *MultipartReader) readPartHeaders() (*headers.Headers, error) {
+	h := headers.NewHeaders()
+	need := 1
+	for {
+		if n := mr.br.Buffered(); n > need {
+			need = n
+		}
+		if need > mr.br.Size() {
+			return nil, ERROR_MULTIPART_HEADERS_TOO_LARGE
+		}
+		data, peekErr := mr.br.Peek(need)
+
+		n, done, err := h.Parse(data)
+		if err != nil {
+			return nil, err
+		}
+		mr.br.Discard(n)
+		if done {
+			return h, nil
+		}
+		if peekErr != nil {
+			if peekErr == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, peekErr
+		}
+		need = len(data) - n + 1
+	}
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	if p.eof {
+		return 0, io.EOF
+	}
+	br := p.mr.br
+	delim := p.mr.nlDashed
+	need := 1
+	for {
+		if n := br.Buffered(); n > need {
+			need = n
+		}
+		need = min(need, br.Size())
+		data, err := br.Peek(need)
+
+		if i := bytes.Index(data, delim); i >= 0 {
+			if i == 0 {
+				p.eof = true
+				return 0, io.EOF
+			}
+			return br.Read(b[:min(len(b), i)])
+		}
+
+		// hold back anything that could be the start of the delimiter
+		safe := len(data) - (len(delim) - 1)
+		if safe > 0 {
+			return br.Read(b[:min(len(b), safe)])
+		}
+		if err != nil {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		need = len(data) + 1
+	}
+}
+
+// FormName returns the name parameter of a form-data Content-Disposition
+func (p *Part) FormName() string {
+	if p.disposition != "form-data" {
+		return ""
+	}
+	return p.dispParams["name"]
+}
+
+// FileName returns the filename parameter of the Content-Disposition
+func (p *Part) FileName() string {
+	return p.dispParams["filename"]
+}
+
+// MultipartForm is a fully parsed multipart/form-data body
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// FileHeader describes an uploaded file, kept in memory or in a temp file
+type FileHeader struct {
+	Filename string
+	Header   *headers.Headers
+	Size     int64
+
+	content []byte
+	tmpfile string
+}
+
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
+
+// Open returns the file content
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return nopReadCloser{bytes.NewReader(fh.content)}, nil
+}
+
+// RemoveAll deletes the temp files created for large file parts
+func (f *MultipartForm) RemoveAll() error {
+	var firstErr error
+	for _, fhs := range f.File {
+		for _, fh := range fhs {
+			if fh.tmpfile == "" {
+				continue
+			}
+			if err := os.Remove(fh.tmpfile); err != nil && !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// ReadForm reads all remaining parts. Files bigger than maxMemory are
+// written to temp files instead of being kept in memory.
+func (mr *MultipartReader) ReadForm(maxMemory int64) (*MultipartForm, error) {
+	form := &MultipartForm{
+		Value: map[string][]string{},
+		File:  map[string][]*FileHeader{},
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, part); err != nil {
+				form.RemoveAll()
+				return nil, err
+			}
+			form.Value[name] = append(form.Value[name], buf.String())
+			continue
+		}
+
+		fh, err := readFilePart(part, maxMemory)
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+		form.File[name] = append(form.File[name], fh)
+	}
+}
+
+func readFilePart(part *Part, maxMemory int64) (*FileHeader, error) {
+	fh := &FileHeader{
+		Filename: part.FileName(),
+		Header:   part.Header,
+	}
+
+	// read one byte past the limit to know if it fits in memory
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= maxMemory {
+		fh.content = buf.Bytes()
+		fh.Size = n
+		return fh, nil
+	}
+
+	file, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	size, err := io.Copy(file, io.MultiReader(&buf, part))
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	fh.tmpfile = file.Name()
+	fh.Size = size
+	return fh, nil
+}
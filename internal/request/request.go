@@ -2,9 +2,12 @@ package request
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net/url"
 )
 
 type parserState string
@@ -21,6 +24,56 @@ type Request struct {
 	Headers     *headers.Headers
 	state       parserState
 	Body        []byte
+
+	// filled by ParseForm / ParseMultipartForm
+	Form          url.Values
+	PostForm      url.Values
+	MultipartForm *MultipartForm
+
+	// TLS is the negotiated connection state (version, cipher suite,
+	// client certificates), nil for plain connections
+	TLS *tls.ConnectionState
+	// RemoteAddr is the client's ip:port, empty when the request was not
+	// read from a connection
+	RemoteAddr string
+
+	// set by HeadAsGet
+	head bool
+
+	// bytes read from the connection after the end of the request
+	unread []byte
+}
+
+// ClientCertificate returns the client's certificate once it has been
+// verified against the server's CA pool, nil otherwise. The rest of the
+// chain is in TLS.VerifiedChains.
+func (r *Request) ClientCertificate() *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Unread returns the bytes that were read from the reader past the end of
+// the request, e.g. the first frames of an upgraded protocol
+func (r *Request) Unread() []byte {
+	return r.unread
+}
+
+// HeadAsGet rewrites a HEAD request into a GET so handlers only have to
+// know about GET. IsHead still reports the original method.
+func (r *Request) HeadAsGet() bool {
+	if r.RequestLine.Method != "HEAD" {
+		return false
+	}
+	r.RequestLine.Method = "GET"
+	r.head = true
+	return true
+}
+
+// IsHead reports whether the client sent a HEAD request
+func (r *Request) IsHead() bool {
+	return r.head || r.RequestLine.Method == "HEAD"
 }
 
 type RequestLine struct {
@@ -143,6 +196,20 @@ func (r *Request) done() bool {
 	return r.state == StateDone
 }
 
+// NewRequest returns a complete request built by other means than the
+// HTTP/1.1 parser, e.g. from HTTP/2 frames
+func NewRequest(method, target, version string, h *headers.Headers, body []byte) *Request {
+	if body == nil {
+		body = []byte{}
+	}
+	return &Request{
+		RequestLine: RequestLine{Method: method, RequestTarget: target, HttpVersion: version},
+		Headers:     h,
+		state:       StateDone,
+		Body:        body,
+	}
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
 	request := &Request{
 		state:   StateInit,
@@ -193,6 +260,9 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 
 	}
 
+	if bufLen > 0 {
+		request.unread = append([]byte(nil), buf[:bufLen]...)
+	}
 	return request, nil
 
 }
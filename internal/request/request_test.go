@@ -1,7 +1,12 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"httpfromtcp/internal/headers"
 	"io"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -168,3 +173,339 @@ func TestParseBody(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 }
+
+// Test: Parsing Forms
+func TestParseForm(t *testing.T) {
+	// Test: urlencoded body with multiple values and a query string
+	body := "name=gopher&tag=a&tag=b+c"
+	reader := &chunkReader{
+		data: "POST /submit?tag=q HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" +
+			body,
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "gopher", r.FormValue("name"))
+	assert.Equal(t, []string{"a", "b c", "q"}, r.Form["tag"])
+	assert.Equal(t, []string{"a", "b c"}, r.PostForm["tag"])
+	assert.Equal(t, "/submit", r.Path())
+
+	// Test: query string only
+	r, err = RequestFromReader(strings.NewReader("GET /search?q=tcp&q=udp HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, []string{"tcp", "udp"}, r.Form["q"])
+	assert.Empty(t, r.PostForm)
+}
+
+func multipartRequest(t *testing.T, body string) *Request {
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: multipart/form-data; boundary=xyz\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" +
+			body,
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	return r
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	body := "preamble\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n" +
+		"\r\n" +
+		"hello\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n" +
+		"\r\n" +
+		"world\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"line one\r\n--xy not a boundary\r\n" +
+		"--xyz--\r\n"
+
+	// Test: streaming parts
+	r := multipartRequest(t, body)
+	mr, err := r.MultipartReader()
+	require.NoError(t, err)
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.FormName())
+	data, err := io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// skip the second part without reading it
+	_, err = mr.NextPart()
+	require.NoError(t, err)
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", part.FileName())
+	contentType, _ := part.Header.Get("content-type")
+	assert.Equal(t, "text/plain", contentType)
+	data, err = io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "line one\r\n--xy not a boundary", string(data))
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: file kept in memory
+	r = multipartRequest(t, body)
+	require.NoError(t, r.ParseMultipartForm(1024))
+	assert.Equal(t, []string{"hello", "world"}, r.Form["title"])
+	require.Len(t, r.MultipartForm.File["file"], 1)
+	fh := r.MultipartForm.File["file"][0]
+	assert.Equal(t, int64(len("line one\r\n--xy not a boundary")), fh.Size)
+	assert.Empty(t, fh.tmpfile)
+
+	// Test: file spilled to disk
+	r = multipartRequest(t, body)
+	require.NoError(t, r.ParseMultipartForm(4))
+	fh = r.MultipartForm.File["file"][0]
+	require.NotEmpty(t, fh.tmpfile)
+	f, err := fh.Open()
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "line one\r\n--xy not a boundary", string(data))
+	require.NoError(t, r.MultipartForm.RemoveAll())
+	_, err = os.Stat(fh.tmpfile)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: missing closing boundary
+	r = multipartRequest(t, "--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nunterminated")
+	require.Error(t, r.ParseMultipartForm(1024))
+}
+
+func jsonRequest(t *testing.T, contentType, body string) *Request {
+	r, err := RequestFromReader(strings.NewReader("POST /api HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		body))
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeJSON(t *testing.T) {
+	type payload struct {
+		Name string `json:"name"`
+	}
+
+	// Test: valid body
+	var p payload
+	r := jsonRequest(t, "application/json; charset=utf-8", `{"name":"gopher"}`)
+	require.NoError(t, r.DecodeJSON(&p))
+	assert.Equal(t, "gopher", p.Name)
+
+	// Test: unknown field is rejected unless allowed
+	r = jsonRequest(t, "application/json", `{"name":"gopher","extra":1}`)
+	assert.ErrorIs(t, r.DecodeJSON(&p), ERROR_INVALID_JSON)
+	require.NoError(t, r.DecodeJSONWithOptions(&p, JSONOptions{AllowUnknownFields: true}))
+
+	// Test: wrong content type
+	r = jsonRequest(t, "text/plain", `{"name":"gopher"}`)
+	assert.ErrorIs(t, r.DecodeJSON(&p), ERROR_UNSUPPORTED_MEDIA_TYPE)
+
+	// Test: body over the limit
+	r = jsonRequest(t, "application/json", `{"name":"a long name"}`)
+	assert.ErrorIs(t, r.DecodeJSONWithOptions(&p, JSONOptions{MaxBytes: 8}), ERROR_BODY_TOO_LARGE)
+
+	// Test: trailing data after the value
+	r = jsonRequest(t, "application/json", `{"name":"a"} {"name":"b"}`)
+	assert.ErrorIs(t, r.DecodeJSON(&p), ERROR_INVALID_JSON)
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return b.Bytes()
+}
+
+func encodedRequest(t *testing.T, encoding string, body []byte) *Request {
+	r, err := RequestFromReader(strings.NewReader("POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Encoding: " + encoding + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		string(body)))
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeBody(t *testing.T) {
+	plain := []byte(`{"name":"gopher"}`)
+
+	// Test: gzip body
+	r := encodedRequest(t, "gzip", gzipBytes(t, plain))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, plain, r.Body)
+	_, ok := r.Headers.Get("content-encoding")
+	assert.False(t, ok)
+	assert.Equal(t, len(plain), headers.GetInt(r.Headers, "content-length", 0))
+
+	// Test: x-gzip is gzip
+	r = encodedRequest(t, "x-gzip", gzipBytes(t, plain))
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, plain, r.Body)
+
+	// Test: every decoder is listed, so a 415 names all of them
+	assert.Len(t, SupportedEncodings, len(decoders))
+	for _, e := range SupportedEncodings {
+		assert.Contains(t, decoders, e)
+	}
+
+	// Test: decoded size over the cap
+	bomb := gzipBytes(t, bytes.Repeat([]byte("a"), 1<<20))
+	r = encodedRequest(t, "gzip", bomb)
+	assert.ErrorIs(t, r.DecodeBody(1024), ERROR_BODY_TOO_LARGE)
+
+	// Test: unsupported encoding
+	r = encodedRequest(t, "br", plain)
+	assert.ErrorIs(t, r.DecodeBody(1024), ERROR_UNSUPPORTED_MEDIA_TYPE)
+
+	// Test: corrupt body
+	r = encodedRequest(t, "gzip", plain)
+	assert.ErrorIs(t, r.DecodeBody(1024), ERROR_MALFORMED_BODY)
+}
+
+func TestHeadAsGet(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("HEAD / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.IsHead())
+	assert.True(t, r.HeadAsGet())
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.True(t, r.IsHead())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.HeadAsGet())
+	assert.False(t, r.IsHead())
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	upgrade := func(extra string) ([]byte, bool) {
+		r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n" + extra + "\r\n"))
+		require.NoError(t, err)
+		return r.H2CUpgrade()
+	}
+
+	// Test: Upgrade, Connection and HTTP2-Settings together are an upgrade
+	settings, ok := upgrade("Upgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n")
+	require.True(t, ok)
+	assert.Equal(t, []byte{0, 3, 0, 0, 0, 100, 0, 4, 0, 0, 0xff, 0xff}, settings)
+
+	// Test: empty settings are fine
+	settings, ok = upgrade("Upgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\nHTTP2-Settings: \r\n")
+	assert.True(t, ok)
+	assert.Empty(t, settings)
+
+	// Test: anything missing or malformed stays HTTP/1.1
+	for _, extra := range []string{
+		"",
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n",
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n",
+		"Upgrade: h2c\r\nConnection: Upgrade\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n",
+		"Upgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\n",
+		"Upgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n",
+		"Upgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\nHTTP2-Settings: AAMAAA\r\n",
+		"Upgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\nHTTP2-Settings: !!!\r\n",
+	} {
+		_, ok := upgrade(extra)
+		assert.False(t, ok, extra)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	fields := func(h *headers.Headers) map[string]string {
+		m := map[string]string{}
+		h.ForEach(func(n, v string) { m[n] = v })
+		return m
+	}
+
+	// Test: parse, write and parse again gives the same request
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		"GET /coffee?size=large HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\nAccept: text/plain\r\n\r\n",
+		"POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Type: application/json\r\nContent-Length: 13\r\n\r\n{\"a\": \"b c\"}\n",
+	} {
+		r, err := RequestFromReader(&chunkReader{data: raw, numBytesPerRead: 3})
+		require.NoError(t, err)
+		var b bytes.Buffer
+		require.NoError(t, r.Write(&b))
+		again, err := RequestFromReader(&chunkReader{data: b.String(), numBytesPerRead: 3})
+		require.NoError(t, err, b.String())
+		assert.Equal(t, r.RequestLine, again.RequestLine)
+		assert.Equal(t, fields(r.Headers), fields(again.Headers))
+		assert.Equal(t, r.Body, again.Body)
+	}
+
+	// Test: Content-Length follows the body
+	h := headers.NewHeaders()
+	h.Set("Host", "example.com")
+	h.Set("Content-Length", "100")
+	var b bytes.Buffer
+	require.NoError(t, NewRequest("PUT", "/items/7", "1.1", h, []byte("payload")).Write(&b))
+	r, err := RequestFromReader(&b)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(r.Body))
+	length, _ := h.Get("content-length")
+	assert.Equal(t, "100", length, "the request's own headers are left alone")
+
+	// Test: no body and no Content-Length, none is added
+	b.Reset()
+	require.NoError(t, NewRequest("GET", "/", "1.1", nil, nil).Write(&b))
+	assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", b.String())
+
+	// Test: Transfer-Encoding chunked frames the body as one chunk
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Content-Length", "7")
+	b.Reset()
+	require.NoError(t, NewRequest("POST", "/upload", "1.1", h, []byte("payload")).Write(&b))
+	assert.Equal(t, "POST /upload HTTP/1.1\r\ntransfer-encoding: chunked\r\n\r\n7\r\npayload\r\n0\r\n\r\n", b.String())
+
+	// Test: HEAD served as GET goes out as HEAD, HTTP/2 as HTTP/1.1
+	r, err = RequestFromReader(strings.NewReader("HEAD / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	r.HeadAsGet()
+	b.Reset()
+	require.NoError(t, r.Write(&b))
+	assert.Equal(t, "HEAD / HTTP/1.1\r\n\r\n", b.String())
+	b.Reset()
+	require.NoError(t, NewRequest("GET", "/", "2", nil, nil).Write(&b))
+	assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", b.String())
+
+	// Test: fields that would break the framing are refused
+	injected := headers.NewHeaders()
+	injected.Set("X-Evil", "a\r\nContent-Length: 0")
+	chunkedLast := headers.NewHeaders()
+	chunkedLast.Set("Transfer-Encoding", "chunked, gzip")
+	for _, r := range []*Request{
+		NewRequest("get", "/", "1.1", nil, nil),
+		NewRequest("GET", "/a b", "1.1", nil, nil),
+		NewRequest("GET", "", "1.1", nil, nil),
+		NewRequest("GET", "/", "1.1", injected, nil),
+		NewRequest("POST", "/", "1.1", chunkedLast, []byte("x")),
+	} {
+		b.Reset()
+		assert.ErrorIs(t, r.Write(&b), ERROR_INVALID_FIELD)
+		assert.Zero(t, b.Len(), "nothing is written")
+	}
+}
@@ -0,0 +1,29 @@
+package request
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// H2CUpgrade recognizes a request to switch a cleartext connection to
+// HTTP/2 (RFC 7540 3.2) and returns the decoded HTTP2-Settings, the
+// payload of a SETTINGS frame. Requests without exactly one valid
+// HTTP2-Settings header are served as HTTP/1.1.
+func (r *Request) H2CUpgrade() ([]byte, bool) {
+	if r.RequestLine.HttpVersion != "1.1" || !r.Headers.HasToken("upgrade", "h2c") {
+		return nil, false
+	}
+	if !r.Headers.HasToken("connection", "upgrade") || !r.Headers.HasToken("connection", "http2-settings") {
+		return nil, false
+	}
+	// repeated headers are joined with commas, which base64url never uses
+	value, ok := r.Headers.Get("http2-settings")
+	if !ok || strings.Contains(value, ",") {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(value), "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+	return settings, true
+}
@@ -0,0 +1,79 @@
+package request
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ERROR_INVALID_FIELD = fmt.Errorf("request can't be written")
+
+// Write sends the request in HTTP/1.1 form: request line, headers and the
+// body framed by Content-Length, or chunked when the headers ask for a
+// Transfer-Encoding. The framing fields are set from the body, the
+// request itself is not changed.
+//
+// A request turned into a GET by HeadAsGet goes out as HEAD again, and
+// one that came in over HTTP/2 as HTTP/1.1.
+func (r *Request) Write(w io.Writer) error {
+	method := r.RequestLine.Method
+	if r.IsHead() {
+		method = "HEAD"
+	}
+	if method == "" || strings.ContainsFunc(method, func(c rune) bool { return c < 'A' || c > 'Z' }) {
+		return fmt.Errorf("%w: method %q", ERROR_INVALID_FIELD, method)
+	}
+	target := r.RequestLine.RequestTarget
+	if target == "" || strings.ContainsAny(target, " \t\r\n") {
+		return fmt.Errorf("%w: request target %q", ERROR_INVALID_FIELD, target)
+	}
+	version := r.RequestLine.HttpVersion
+	if version != "1.0" {
+		version = "1.1"
+	}
+
+	h := headers.NewHeaders()
+	if r.Headers != nil {
+		h = r.Headers.Clone()
+	}
+	te, chunked := h.Get("transfer-encoding")
+	if chunked {
+		// chunked has to be the last coding applied, RFC 9112 6.1
+		codings := strings.Split(te, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return fmt.Errorf("%w: transfer-encoding %q", ERROR_INVALID_FIELD, te)
+		}
+		h.Delete("content-length")
+	} else if _, hasLength := h.Get("content-length"); hasLength || len(r.Body) > 0 {
+		h.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+
+	b := fmt.Appendf(nil, "%s %s HTTP/%s\r\n", method, target, version)
+	var err error
+	h.ForEach(func(n, v string) {
+		// a CR or LF would end the field early and smuggle in another
+		if n == "" || strings.ContainsAny(n, " \t\r\n:") || strings.ContainsAny(v, "\r\n\x00") {
+			err = fmt.Errorf("%w: field %q", ERROR_INVALID_FIELD, n)
+		}
+		b = fmt.Appendf(b, "%s: %s\r\n", n, v)
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, END_OF_LINE...)
+
+	if chunked {
+		if len(r.Body) > 0 {
+			b = fmt.Appendf(b, "%x\r\n", len(r.Body))
+			b = append(b, r.Body...)
+			b = append(b, END_OF_LINE...)
+		}
+		b = append(b, "0\r\n\r\n"...)
+	} else {
+		b = append(b, r.Body...)
+	}
+	_, err = w.Write(b)
+	return err
+}
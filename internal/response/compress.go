@@ -0,0 +1,204 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoder is a streaming body encoder such as *gzip.Writer
+type Encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var encoders = map[string]func(w io.Writer) (Encoder, error){
+	"gzip": func(w io.Writer) (Encoder, error) {
+		return gzip.NewWriter(w), nil
+	},
+	// the "deflate" content-coding is zlib framed, not raw deflate
+	"deflate": func(w io.Writer) (Encoder, error) {
+		return zlib.NewWriter(w), nil
+	},
+	// one goroutine per body, and a window browsers are required to
+	// handle (RFC 8878 3.1.1.1.2 recommends at most 8 MB)
+	"zstd": func(w io.Writer) (Encoder, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+	},
+}
+
+// RegisterEncoder adds a content-coding, e.g. br from a third party
+// package, or replaces one of ours
+func RegisterEncoder(name string, newEncoder func(w io.Writer) (Encoder, error)) {
+	encoders[strings.ToLower(name)] = newEncoder
+}
+
+// HasEncoder reports whether the content-coding can be produced
+func HasEncoder(name string) bool {
+	_, ok := encoders[strings.ToLower(name)]
+	return ok
+}
+
+type compression struct {
+	encoding string
+	minSize  int
+}
+
+// SetCompression asks the writer to encode the body with encoding.
+// Bodies known to be smaller than minSize and already compressed content
+// types are sent as is. An empty encoding only adds Vary: Accept-Encoding,
+// for clients that didn't accept any of our encodings.
+// It must be called before the headers are sent.
+func (w *Writer) SetCompression(encoding string, minSize int) error {
+	if w.committed {
+		return fmt.Errorf("cannot enable compression after the headers are sent")
+	}
+	if encoding != "" && !HasEncoder(encoding) {
+		return fmt.Errorf("unsupported content-coding %q", encoding)
+	}
+	w.compression = &compression{encoding: strings.ToLower(encoding), minSize: minSize}
+	return nil
+}
+
+// content types that are compressed already and don't shrink any further
+var compressedTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+}
+
+func isCompressedType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	// svg is text
+	if strings.HasPrefix(contentType, "image/svg+xml") {
+		return false
+	}
+	for _, prefix := range compressedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddVary appends a field name to the Vary header unless it is there
+func AddVary(h *headers.Headers, name string) {
+	vary, _ := h.Get("vary")
+	for _, v := range strings.Split(vary, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.EqualFold(v, name) {
+			return
+		}
+	}
+	h.Add("Vary", name)
+}
+
+func (w *Writer) shouldCompress(complete bool) bool {
+	c := w.compression
+	if c.encoding == "" || !bodyAllowed(w.status) {
+		return false
+	}
+	if _, ok := w.header.Get("content-encoding"); ok {
+		return false
+	}
+	// a range of the encoded body is useless to a client that asked for a
+	// range of the identity one, multipart/byteranges included
+	if _, ok := w.header.Get("content-range"); ok || w.status == StatusPartialContent {
+		return false
+	}
+	if contentType, _ := w.header.Get("content-type"); isCompressedType(contentType) {
+		return false
+	}
+	if complete && len(w.buf) < c.minSize {
+		return false
+	}
+	return true
+}
+
+// setupEncoding runs when the headers are committed. A complete body is
+// compressed in one go so it still gets a Content-Length, anything else is
+// streamed through an encoder into chunks.
+func (w *Writer) setupEncoding(complete bool) error {
+	if w.compression == nil {
+		return nil
+	}
+	AddVary(w.header, "Accept-Encoding")
+	if !w.shouldCompress(complete) {
+		return nil
+	}
+
+	newEncoder := encoders[w.compression.encoding]
+	w.header.Set("Content-Encoding", w.compression.encoding)
+	w.header.Delete("content-length")
+	if etag, ok := w.header.Get("etag"); ok {
+		w.header.Set("ETag", encodedETag(etag, w.compression.encoding))
+	}
+
+	if complete {
+		var b bytes.Buffer
+		enc, err := newEncoder(&b)
+		if err != nil {
+			return err
+		}
+		if _, err := enc.Write(w.buf); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		w.buf = b.Bytes()
+		return nil
+	}
+
+	if !isChunked(w.header) {
+		w.header.Set("Transfer-Encoding", "chunked")
+	}
+	enc, err := newEncoder(framedWriter{w})
+	if err != nil {
+		return err
+	}
+	w.encoder = enc
+	return nil
+}
+
+// framedWriter lets an encoder write into the committed framing
+type framedWriter struct {
+	w *Writer
+}
+
+func (f framedWriter) Write(p []byte) (int, error) {
+	return f.w.writeFramed(p)
+}
+
+// writeBodyBytes sends body bytes through the encoder if there is one
+func (w *Writer) writeBodyBytes(p []byte) (int, error) {
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.writeFramed(p)
+}
+
+// closeEncoder writes what the encoder still holds, e.g. the gzip footer
+func (w *Writer) closeEncoder() error {
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	w.encoder = nil
+	return err
+}
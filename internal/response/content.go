@@ -0,0 +1,199 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType guesses the type from the name's extension and sniffs the
+// first 512 bytes of content when the extension is unknown
+func ContentType(name string, content io.ReadSeeker) (string, error) {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// ServeContent writes content as the response body. Conditional requests
+// are answered with 304 or 412, Range requests with 206
+// (multipart/byteranges for several ranges) or 416.
+// name is only used to guess the Content-Type, a zero modtime leaves out
+// Last-Modified. h holds extra headers such as ETag or Content-Type and may
+// be nil.
+func ServeContent(w *Writer, req *request.Request, name string, modtime time.Time, content io.ReadSeeker, h *headers.Headers) error {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if h == nil {
+		h = headers.NewHeaders()
+	} else {
+		h = h.Clone()
+	}
+	ctype, ok := h.Get("content-type")
+	if !ok {
+		if ctype, err = ContentType(name, content); err != nil {
+			return err
+		}
+		h.Set("Content-Type", ctype)
+	}
+	h.Set("Accept-Ranges", "bytes")
+	if !modtime.IsZero() {
+		h.Set("Last-Modified", modtime.UTC().Format(TimeFormat))
+	}
+
+	if status := CheckPreconditions(req, h, modtime); status != 0 {
+		return w.WritePrecondition(status, h)
+	}
+
+	rangeHeader, hasRange := req.Headers.Get("range")
+	if !hasRange || req.RequestLine.Method != "GET" || !ifRangeMatches(req, h, modtime) {
+		return serveFull(w, h, content, size)
+	}
+
+	ranges, err := ParseRange(rangeHeader, size)
+	switch {
+	case errors.Is(err, ERROR_RANGE_NOT_SATISFIABLE):
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		h.Set("Content-Length", "0")
+		h.Delete("content-type")
+		if err := w.WriteStatusLine(StatusRangeNotSatisfiable); err != nil {
+			return err
+		}
+		return w.WriteHeaders(*h)
+	case err != nil:
+		// a Range we can't make sense of is ignored
+		return serveFull(w, h, content, size)
+	}
+
+	// ranges adding up to more than the whole thing are not worth it
+	var total int64
+	for _, r := range ranges {
+		total += r.Length
+	}
+	if total > size {
+		return serveFull(w, h, content, size)
+	}
+
+	if len(ranges) == 1 {
+		return serveRange(w, h, content, size, ranges[0])
+	}
+	return serveMultiRange(w, h, content, size, ctype, ranges)
+}
+
+// ifRangeMatches reports whether a Range can be honored. A failed If-Range
+// means the client has an outdated copy and needs the full body.
+func ifRangeMatches(req *request.Request, h *headers.Headers, modtime time.Time) bool {
+	value, ok := req.Headers.Get("if-range")
+	if !ok {
+		return true
+	}
+	value = strings.TrimSpace(value)
+
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		// If-Range needs the strong comparison
+		etag, ok := h.Get("etag")
+		return ok && !strings.HasPrefix(value, "W/") && !strings.HasPrefix(etag, "W/") && etag == value
+	}
+
+	t, err := time.Parse(TimeFormat, value)
+	return err == nil && !modtime.IsZero() && modtime.UTC().Truncate(time.Second).Equal(t)
+}
+
+func serveFull(w *Writer, h *headers.Headers, content io.Reader, size int64) error {
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+	if err := w.WriteStatusLine(StatusOK); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, content, size)
+	return err
+}
+
+func serveRange(w *Writer, h *headers.Headers, content io.ReadSeeker, size int64, r ByteRange) error {
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+	h.Set("Content-Range", r.contentRange(size))
+	h.Set("Content-Length", strconv.FormatInt(r.Length, 10))
+	if err := w.WriteStatusLine(StatusPartialContent); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, content, r.Length)
+	return err
+}
+
+func randomBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func serveMultiRange(w *Writer, h *headers.Headers, content io.ReadSeeker, size int64, ctype string, ranges []ByteRange) error {
+	boundary := randomBoundary()
+
+	// part headers are built up front so Content-Length is known
+	partHeaders := make([]string, len(ranges))
+	var length int64
+	for i, r := range ranges {
+		prefix := ""
+		if i > 0 {
+			prefix = "\r\n"
+		}
+		partHeaders[i] = fmt.Sprintf("%s--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", prefix, boundary, ctype, r.contentRange(size))
+		length += int64(len(partHeaders[i])) + r.Length
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	length += int64(len(closing))
+
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if err := w.WriteStatusLine(StatusPartialContent); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+
+	for i, r := range ranges {
+		if _, err := w.Write([]byte(partHeaders[i])); err != nil {
+			return err
+		}
+		if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, content, r.Length); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte(closing))
+	return err
+}
@@ -0,0 +1,45 @@
+package response
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// the formatted Date value only changes once per second, so it is cached
+// and shared by every response instead of formatted per request
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+var dateCache atomic.Pointer[cachedDate]
+
+// httpDate returns the current time in IMF-fixdate format
+func httpDate() string {
+	now := time.Now()
+	if c := dateCache.Load(); c != nil && c.unix == now.Unix() {
+		return c.value
+	}
+	c := &cachedDate{unix: now.Unix(), value: now.UTC().Format(TimeFormat)}
+	dateCache.Store(c)
+	return c.value
+}
+
+// SetServerName adds a Server header to the response unless the handler
+// sets one. An empty name leaves it out.
+func (w *Writer) SetServerName(name string) {
+	w.serverName = name
+}
+
+// addDefaultHeaders fills in Date (RFC 9110 6.6.1) and Server right before
+// the headers are sent
+func (w *Writer) addDefaultHeaders() {
+	if _, ok := w.header.Get("date"); !ok {
+		w.header.Set("Date", httpDate())
+	}
+	if w.serverName != "" {
+		if _, ok := w.header.Get("server"); !ok {
+			w.header.Set("Server", w.serverName)
+		}
+	}
+}
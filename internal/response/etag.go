@@ -0,0 +1,253 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"strings"
+	"time"
+)
+
+// StrongETag quotes an opaque tag, e.g. abc -> "abc"
+func StrongETag(tag string) string {
+	return `"` + tag + `"`
+}
+
+// WeakETag quotes an opaque tag as a weak validator, e.g. abc -> W/"abc"
+func WeakETag(tag string) string {
+	return `W/"` + tag + `"`
+}
+
+// ETagFor hashes a body into a strong entity tag
+func ETagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return StrongETag(hex.EncodeToString(sum[:16]))
+}
+
+// encodedETag tags an encoded representation apart from the identity one,
+// e.g. "abc" -> "abc-gzip". Both carry the same bytes once decoded, but a
+// cache must not hand one out for the other, RFC 9110 8.8.3.
+func encodedETag(etag, encoding string) string {
+	if !strings.HasSuffix(etag, `"`) || len(opaque(etag)) < 2 {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+func isWeak(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+func opaque(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+// strong comparison: both must be strong and identical
+func strongMatch(a, b string) bool {
+	return !isWeak(a) && !isWeak(b) && a == b
+}
+
+// weak comparison: the opaque tags must match, W/ is ignored
+func weakMatch(a, b string) bool {
+	return opaque(a) == opaque(b)
+}
+
+// parseETags splits an If-Match / If-None-Match list. Commas are allowed
+// inside the quotes, so a plain split on "," is not enough.
+func parseETags(value string) []string {
+	var etags []string
+	for {
+		value = strings.TrimLeft(value, " \t,")
+		if value == "" {
+			return etags
+		}
+		if value[0] == '*' {
+			etags = append(etags, "*")
+			value = value[1:]
+			continue
+		}
+
+		start := 0
+		if strings.HasPrefix(value, "W/") {
+			start = 2
+		}
+		if len(value) <= start || value[start] != '"' {
+			// not an entity tag, skip to the next element
+			i := strings.IndexByte(value, ',')
+			if i < 0 {
+				return etags
+			}
+			value = value[i:]
+			continue
+		}
+		end := strings.IndexByte(value[start+1:], '"')
+		if end < 0 {
+			return etags
+		}
+		end += start + 2
+		etags = append(etags, value[:end])
+		value = value[end:]
+	}
+}
+
+func matchesAny(list, etag string, match func(a, b string) bool) bool {
+	_, ok := matchingETag(list, etag, match)
+	return ok
+}
+
+// matchingETag returns the element of list that matches etag
+func matchingETag(list, etag string, match func(a, b string) bool) (string, bool) {
+	for _, candidate := range parseETags(list) {
+		if candidate == "*" {
+			return candidate, true
+		}
+		if etag != "" && match(candidate, etag) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// matchingEncodedETag looks for one of the tags the body got when it was
+// sent compressed, see encodedETag
+func matchingEncodedETag(list, etag string) (string, bool) {
+	if etag == "" {
+		return "", false
+	}
+	for encoding := range encoders {
+		if candidate, ok := matchingETag(list, encodedETag(etag, encoding), weakMatch); ok {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	t, err := time.Parse(TimeFormat, strings.TrimSpace(value))
+	return t, err == nil
+}
+
+// CheckPreconditions evaluates If-Match, If-Unmodified-Since,
+// If-None-Match and If-Modified-Since in the order of RFC 9110 13.2.2
+// against the validators in h (ETag) and modtime.
+// It returns StatusNotModified, StatusPreconditionFailed or 0 when the
+// request should go on as normal.
+// If-None-Match also matches the tags of compressed copies of the body.
+// The ETag in h is then set to the matching one, so a 304 carries the tag
+// the client has.
+func CheckPreconditions(req *request.Request, h *headers.Headers, modtime time.Time) StatusCode {
+	etag, _ := h.Get("etag")
+	method := req.RequestLine.Method
+	modtime = modtime.UTC().Truncate(time.Second)
+
+	if ifMatch, ok := req.Headers.Get("if-match"); ok {
+		if !matchesAny(ifMatch, etag, strongMatch) {
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := req.Headers.Get("if-unmodified-since"); ok && !modtime.IsZero() {
+		if t, ok := parseHTTPDate(since); ok && modtime.After(t) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch, ok := req.Headers.Get("if-none-match"); ok {
+		matched := matchesAny(ifNoneMatch, etag, weakMatch)
+		if !matched {
+			var encoded string
+			if encoded, matched = matchingEncodedETag(ifNoneMatch, etag); matched {
+				h.Set("ETag", encoded)
+			}
+		}
+		if matched {
+			if method == "GET" || method == "HEAD" {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if since, ok := req.Headers.Get("if-modified-since"); ok && !modtime.IsZero() {
+		if method == "GET" || method == "HEAD" {
+			if t, ok := parseHTTPDate(since); ok && !modtime.After(t) {
+				return StatusNotModified
+			}
+		}
+	}
+	return 0
+}
+
+// the only fields a 304 keeps, RFC 9110 15.4.5
+var notModifiedFields = []string{
+	"cache-control",
+	"content-location",
+	"date",
+	"etag",
+	"expires",
+	"vary",
+	"last-modified",
+	"connection",
+	"server",
+}
+
+// notModifiedHeaders strips h down to what a 304 may carry
+func notModifiedHeaders(h *headers.Headers) *headers.Headers {
+	out := headers.NewHeaders()
+	for _, name := range notModifiedFields {
+		if v, ok := h.Get(name); ok {
+			out.Set(name, v)
+		}
+	}
+	// Last-Modified is only useful when there is no ETag
+	if _, ok := out.Get("etag"); ok {
+		out.Delete("last-modified")
+	}
+	return out
+}
+
+// WritePrecondition writes the 304 or 412 returned by CheckPreconditions
+func (w *Writer) WritePrecondition(status StatusCode, h *headers.Headers) error {
+	var out *headers.Headers
+	if status == StatusNotModified {
+		out = notModifiedHeaders(h)
+	} else {
+		out = GetDefaultHeaders(0)
+		out.Delete("content-type")
+	}
+	if err := w.WriteStatusLine(status); err != nil {
+		return err
+	}
+	return w.WriteHeaders(*out)
+}
+
+// SetAutoETag makes a buffered writer hash complete 200 bodies into an
+// ETag (unless the handler set one) and answer If-None-Match / If-Match
+// of req on its own with 304 or 412
+func (w *Writer) SetAutoETag(req *request.Request) {
+	w.autoETag = req
+}
+
+// applyAutoETag runs at commit time when the whole body is buffered
+func (w *Writer) applyAutoETag() {
+	req := w.autoETag
+	if req == nil || w.status != StatusOK {
+		return
+	}
+	if _, ok := w.header.Get("etag"); !ok {
+		w.header.Set("ETag", ETagFor(w.buf))
+	}
+
+	var modtime time.Time
+	if lastModified, ok := w.header.Get("last-modified"); ok {
+		modtime, _ = parseHTTPDate(lastModified)
+	}
+	switch CheckPreconditions(req, w.header, modtime) {
+	case StatusNotModified:
+		w.status = StatusNotModified
+		w.header = notModifiedHeaders(w.header)
+		w.buf = nil
+	case StatusPreconditionFailed:
+		w.status = StatusPreconditionFailed
+		w.header = GetDefaultHeaders(0)
+		w.header.Delete("content-type")
+		w.buf = nil
+	}
+}
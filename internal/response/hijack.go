@@ -0,0 +1,78 @@
+package response
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"net"
+)
+
+var ERROR_HIJACKED = fmt.Errorf("connection has been hijacked")
+var ERROR_NOT_HIJACKABLE = fmt.Errorf("writer does not support hijacking")
+
+// HijackFunc hands over the connection together with the bytes the
+// request parser already read past the end of the request
+type HijackFunc func() (net.Conn, []byte, error)
+
+// SetHijacker is called by the server, which owns the connection
+func (w *Writer) SetHijacker(hijack HijackFunc) {
+	w.hijacker = hijack
+}
+
+// Hijack lets the handler take over the raw connection, e.g. for
+// websockets or CONNECT tunnels. Whatever the handler wrote so far is sent
+// as is (no framing headers are added), then every other Writer method
+// fails with ERROR_HIJACKED. The caller must close the connection.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.state == stateHijacked {
+		return nil, nil, ERROR_HIJACKED
+	}
+	if w.hijacker == nil {
+		return nil, nil, ERROR_NOT_HIJACKABLE
+	}
+
+	// without the buffer limit commit doesn't pick a framing
+	w.bufferLimit = 0
+	if w.state == stateHeaders {
+		if err := w.WriteHeaders(*headers.NewHeaders()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if w.state == stateBody {
+		if err := w.commit(false); err != nil {
+			return nil, nil, err
+		}
+		if err := w.closeEncoder(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := w.flushWriter(); err != nil {
+		return nil, nil, err
+	}
+
+	w.state = stateHijacked
+	return w.hijacker()
+}
+
+// Abort gives up on a response that can't be completed, e.g. when the
+// handler fails after the status went out. The connection is closed
+// without sending what is still buffered, so the client sees a cut off
+// response rather than one that looks complete. On a stream the server
+// resets it instead. Afterwards the writer behaves as if hijacked.
+func (w *Writer) Abort() error {
+	if w.state == stateHijacked {
+		return ERROR_HIJACKED
+	}
+	w.state = stateHijacked
+	w.buf = nil
+	if w.stream != nil {
+		return nil
+	}
+	if w.hijacker == nil {
+		return ERROR_NOT_HIJACKABLE
+	}
+	conn, _, err := w.hijacker()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,99 @@
+package response
+
+import (
+	"encoding/json"
+	"fmt"
+	"httpfromtcp/internal/headers"
+)
+
+// WriteJSON writes a complete response with v encoded as the JSON body
+func (w *Writer) WriteJSON(statusCode StatusCode, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.writeWithContentType(statusCode, "application/json", body)
+}
+
+// Problem is an RFC 9457 problem details object
+type Problem struct {
+	Type     string
+	Title    string
+	Status   StatusCode
+	Detail   string
+	Instance string
+	// Extensions are extra members serialized next to the standard ones
+	Extensions map[string]any
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := map[string]any{}
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+
+	// "about:blank" is the default type, so it can be left out
+	if p.Type != "" {
+		m["type"] = p.Type
+	}
+	title := p.Title
+	if title == "" && (p.Type == "" || p.Type == "about:blank") {
+		title = StatusText(p.Status)
+	}
+	if title != "" {
+		m["title"] = title
+	}
+	if p.Status != 0 {
+		m["status"] = int(p.Status)
+	}
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// WriteProblem writes p as an application/problem+json response
+func (w *Writer) WriteProblem(p Problem) error {
+	return w.WriteProblemWithHeaders(p, nil)
+}
+
+// WriteProblemWithHeaders is WriteProblem with extra response headers,
+// e.g. Allow for a 405 or Accept-Encoding for a 415
+func (w *Writer) WriteProblemWithHeaders(p Problem, extra *headers.Headers) error {
+	if p.Status == 0 {
+		p.Status = StatusInternalServerError
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return w.writeWithHeaders(p.Status, extra, "application/problem+json", body)
+}
+
+func (w *Writer) writeWithContentType(statusCode StatusCode, contentType string, body []byte) error {
+	return w.writeWithHeaders(statusCode, nil, contentType, body)
+}
+
+func (w *Writer) writeWithHeaders(statusCode StatusCode, extra *headers.Headers, contentType string, body []byte) error {
+	h := GetDefaultHeaders(len(body))
+	if extra != nil {
+		extra.ForEach(func(n, v string) {
+			h.Set(n, v)
+		})
+	}
+	h.Set("Content-Type", contentType)
+
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+	if _, err := w.WriteBody(body); err != nil {
+		return fmt.Errorf("writing json body: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package response
+
+import (
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal/headers"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splits a raw response into head and body, every head line ends in CRLF
+func splitResponse(t *testing.T, out string) (string, string) {
+	head, body, ok := strings.Cut(out, "\r\n\r\n")
+	require.True(t, ok, out)
+	return head + "\r\n", body
+}
+
+func TestWriteJSON(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	require.NoError(t, w.WriteJSON(StatusCreated, map[string]any{"name": "gopher", "id": 7}))
+
+	// Test: status, content type and length match the encoded body
+	head, body := splitResponse(t, out.String())
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, head, "content-type: application/json\r\n")
+	assert.Contains(t, head, "content-length: 24\r\n")
+	assert.JSONEq(t, `{"name":"gopher","id":7}`, body)
+
+	// Test: a value that can't be encoded writes nothing
+	out.Reset()
+	w = NewWriter(&out)
+	assert.Error(t, w.WriteJSON(StatusOK, func() {}))
+	assert.Empty(t, out.String())
+}
+
+func TestProblem(t *testing.T) {
+	marshal := func(p Problem) map[string]any {
+		b, err := json.Marshal(p)
+		require.NoError(t, err)
+		var m map[string]any
+		require.NoError(t, json.Unmarshal(b, &m))
+		return m
+	}
+
+	// Test: about:blank is left out and the title defaults to the reason phrase
+	assert.Equal(t, map[string]any{"title": "Not Found", "status": float64(404), "detail": "no such item"},
+		marshal(Problem{Status: StatusNotFound, Detail: "no such item"}))
+	assert.Equal(t, map[string]any{"type": "about:blank", "title": "Bad Request", "status": float64(400)},
+		marshal(Problem{Type: "about:blank", Status: StatusBadRequest}))
+
+	// Test: a custom type gets no made up title
+	assert.Equal(t, map[string]any{"type": "https://example.com/out-of-credit", "status": float64(403), "instance": "/account/12345"},
+		marshal(Problem{Type: "https://example.com/out-of-credit", Status: StatusCode(403), Instance: "/account/12345"}))
+
+	// Test: extension members sit next to the standard ones, which win a clash
+	assert.Equal(t, map[string]any{"title": "Bad Request", "status": float64(400), "balance": float64(30), "accounts": []any{"/account/1"}},
+		marshal(Problem{Status: StatusBadRequest, Extensions: map[string]any{"balance": 30, "accounts": []string{"/account/1"}, "status": 200}}))
+}
+
+func TestWriteProblem(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	require.NoError(t, w.WriteProblem(Problem{Status: StatusUnprocessableEntity, Detail: "name is required"}))
+
+	// Test: problem+json with the problem's status
+	head, body := splitResponse(t, out.String())
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 422 Unprocessable Content\r\n"))
+	assert.Contains(t, head, "content-type: application/problem+json\r\n")
+	assert.JSONEq(t, `{"title":"Unprocessable Content","status":422,"detail":"name is required"}`, body)
+
+	// Test: a problem without a status is a 500
+	out.Reset()
+	w = NewWriter(&out)
+	require.NoError(t, w.WriteProblem(Problem{Detail: "boom"}))
+	head, body = splitResponse(t, out.String())
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.JSONEq(t, `{"title":"Internal Server Error","status":500,"detail":"boom"}`, body)
+}
+
+func TestWriteProblemWithHeaders(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	extra := headers.NewHeaders()
+	extra.Set("Allow", "GET, HEAD")
+	extra.Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteProblemWithHeaders(Problem{Status: StatusMethodNotAllowed}, extra))
+
+	// Test: the extra headers go out, the problem keeps its content type
+	head, body := splitResponse(t, out.String())
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, head, "allow: GET, HEAD\r\n")
+	assert.Contains(t, head, "content-type: application/problem+json\r\n")
+	assert.NotContains(t, head, "text/plain")
+	assert.JSONEq(t, `{"title":"Method Not Allowed","status":405}`, body)
+}
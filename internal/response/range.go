@@ -0,0 +1,94 @@
+package response
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ERROR_RANGE_NOT_SATISFIABLE = fmt.Errorf("range not satisfiable")
+var ERROR_INVALID_RANGE = fmt.Errorf("invalid range")
+
+// more ranges than this in one request are ignored, they are mostly
+// used to make the server do lots of small seeks
+const maxRanges = 16
+
+// ByteRange is a resolved byte range, Start and Length are never negative
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+func (r ByteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a Range header like "bytes=0-99,-500" against a
+// representation of size bytes.
+// It returns ERROR_INVALID_RANGE for headers that should be ignored and
+// ERROR_RANGE_NOT_SATISFIABLE when none of the ranges overlap the content.
+func ParseRange(value string, size int64) ([]ByteRange, error) {
+	unit, spec, ok := strings.Cut(value, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, ERROR_INVALID_RANGE
+	}
+
+	var ranges []ByteRange
+	seen := 0
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, ERROR_INVALID_RANGE
+	}
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		seen++
+		first, last, ok := strings.Cut(s, "-")
+		if !ok {
+			return nil, ERROR_INVALID_RANGE
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r ByteRange
+		if first == "" {
+			// suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, ERROR_INVALID_RANGE
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = ByteRange{Start: size - n, Length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, ERROR_INVALID_RANGE
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, ERROR_INVALID_RANGE
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = ByteRange{Start: start, Length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if seen == 0 {
+		return nil, ERROR_INVALID_RANGE
+	}
+	if len(ranges) == 0 {
+		return nil, ERROR_RANGE_NOT_SATISFIABLE
+	}
+	return ranges, nil
+}
@@ -0,0 +1,365 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ERROR_MALFORMED_STATUS_LINE = fmt.Errorf("malformed status-line")
+var ERROR_MALFORMED_CHUNK = fmt.Errorf("malformed chunk")
+var ERROR_INVALID_FRAMING = fmt.Errorf("invalid body framing")
+var ERROR_HEADERS_TOO_LARGE = fmt.Errorf("response head is too large")
+var END_OF_LINE = []byte("\r\n")
+
+// the status line and headers together may not be bigger than this
+const maxHeadSize = 1 << 20
+
+type parserState string
+
+const (
+	StateStatusLine parserState = "status line"
+	StateHeaders    parserState = "headers"
+	// body bytes: the whole body, or the data of one chunk
+	StateBody      parserState = "body"
+	StateChunkSize parserState = "chunk size"
+	StateChunkEnd  parserState = "chunk end"
+	StateTrailers  parserState = "trailers"
+	StateDone      parserState = "done"
+)
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+// Response is a response read by ResponseFromReader. The head is parsed
+// up front, the body is read through Body as the caller asks for it.
+type Response struct {
+	StatusLine StatusLine
+	Headers    *headers.Headers
+	// Trailers of a chunked body, complete once Body returned io.EOF
+	Trailers *headers.Headers
+	// Body yields the body without its framing, then io.EOF
+	Body io.Reader
+
+	state parserState
+	// the method of the request, HEAD responses have no body
+	method string
+	// body bytes left in the body or the current chunk, -1 until the
+	// connection closes
+	remaining      int64
+	chunked        bool
+	closeDelimited bool
+
+	src    io.Reader
+	buf    []byte
+	bufLen int
+}
+
+// parseStatusLine reads "HTTP/1.1 200 OK\r\n", the reason phrase may be
+// empty. It returns 0 bytes read while the line is incomplete.
+func parseStatusLine(data []byte) (*StatusLine, int, error) {
+	i := bytes.Index(data, END_OF_LINE)
+	if i == -1 {
+		return nil, 0, nil
+	}
+	line := string(data[:i])
+
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok || (version != "HTTP/1.1" && version != "HTTP/1.0") {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	status, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || status < 100 {
+		return nil, 0, ERROR_MALFORMED_STATUS_LINE
+	}
+	return &StatusLine{
+		HttpVersion:  strings.TrimPrefix(version, "HTTP/"),
+		StatusCode:   StatusCode(status),
+		ReasonPhrase: reason,
+	}, i + len(END_OF_LINE), nil
+}
+
+// parse consumes framing: the head, chunk size lines, the CRLF after chunk
+// data and trailers. It stops at body bytes, which Read hands out.
+func (r *Response) parse(data []byte) (int, error) {
+	read := 0
+	for {
+		currentData := data[read:]
+		switch r.state {
+		case StateStatusLine:
+			sl, n, err := parseStatusLine(currentData)
+			if err != nil {
+				return 0, err
+			}
+			if n == 0 {
+				return read, nil
+			}
+			r.StatusLine = *sl
+			read += n
+			r.state = StateHeaders
+
+		case StateHeaders:
+			n, done, err := r.Headers.Parse(currentData)
+			if err != nil {
+				return 0, err
+			}
+			read += n
+			if !done {
+				return read, nil
+			}
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
+
+		case StateChunkSize:
+			i := bytes.Index(currentData, END_OF_LINE)
+			if i == -1 {
+				return read, nil
+			}
+			// chunk extensions are ignored
+			sizeField, _, _ := strings.Cut(string(currentData[:i]), ";")
+			size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+			if err != nil || size < 0 {
+				return 0, ERROR_MALFORMED_CHUNK
+			}
+			read += i + len(END_OF_LINE)
+			if size == 0 {
+				r.state = StateTrailers
+			} else {
+				r.remaining = size
+				r.state = StateBody
+			}
+
+		case StateChunkEnd:
+			if len(currentData) < len(END_OF_LINE) {
+				return read, nil
+			}
+			if !bytes.HasPrefix(currentData, END_OF_LINE) {
+				return 0, ERROR_MALFORMED_CHUNK
+			}
+			read += len(END_OF_LINE)
+			r.state = StateChunkSize
+
+		case StateTrailers:
+			n, done, err := r.Trailers.Parse(currentData)
+			if err != nil {
+				return 0, err
+			}
+			read += n
+			if !done {
+				return read, nil
+			}
+			r.state = StateDone
+
+		default:
+			return read, nil
+		}
+	}
+}
+
+// startBody picks the body framing once the headers are in, RFC 9112 6.3.
+// Interim 1xx responses are dropped and the parser starts over.
+func (r *Response) startBody() error {
+	status := r.StatusLine.StatusCode
+	if status < 200 && status != StatusSwitchingProtocols {
+		r.Headers = headers.NewHeaders()
+		r.state = StateStatusLine
+		return nil
+	}
+
+	te, hasTE := r.Headers.Get("transfer-encoding")
+	length, hasLength := r.Headers.Get("content-length")
+	switch {
+	case r.method == "HEAD" || !bodyAllowed(status):
+		r.state = StateDone
+	case hasTE:
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return fmt.Errorf("%w: transfer-encoding %q", ERROR_INVALID_FRAMING, te)
+		}
+		r.chunked = true
+		r.state = StateChunkSize
+	case hasLength:
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: content-length %q", ERROR_INVALID_FRAMING, length)
+		}
+		r.remaining = n
+		r.state = StateBody
+		if n == 0 {
+			r.state = StateDone
+		}
+	default:
+		// the body ends when the server closes the connection
+		r.remaining = -1
+		r.closeDelimited = true
+		r.state = StateBody
+	}
+	return nil
+}
+
+// fill reads more from the source, growing the buffer when it is full
+func (r *Response) fill() error {
+	if r.bufLen == len(r.buf) {
+		if len(r.buf) >= maxHeadSize {
+			return ERROR_HEADERS_TOO_LARGE
+		}
+		grown := make([]byte, 2*len(r.buf))
+		copy(grown, r.buf[:r.bufLen])
+		r.buf = grown
+	}
+	n, err := r.src.Read(r.buf[r.bufLen:])
+	r.bufLen += n
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		return io.ErrNoProgress
+	}
+	return err
+}
+
+func (r *Response) consume(n int) {
+	copy(r.buf, r.buf[n:r.bufLen])
+	r.bufLen -= n
+}
+
+// advance runs the parser until it reaches body bytes or the end
+func (r *Response) advance() error {
+	for r.state != StateBody && r.state != StateDone {
+		n, err := r.parse(r.buf[:r.bufLen])
+		if err != nil {
+			return err
+		}
+		r.consume(n)
+		if r.state == StateBody || r.state == StateDone {
+			return nil
+		}
+		if err := r.fill(); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Unread returns the bytes read from the reader past the end of the
+// response, e.g. the start of the next one on a kept-alive connection
+func (r *Response) Unread() []byte {
+	return r.buf[:r.bufLen]
+}
+
+// Done reports whether the whole response, trailers included, was read
+func (r *Response) Done() bool {
+	return r.state == StateDone
+}
+
+// KeepAlive reports whether the connection can carry another exchange:
+// the response was read to its end, its framing said where that is and
+// the server didn't ask to close (RFC 9112 9.3)
+func (r *Response) KeepAlive() bool {
+	if !r.Done() || r.closeDelimited || r.bufLen > 0 || r.StatusLine.StatusCode == StatusSwitchingProtocols {
+		return false
+	}
+	connection, _ := r.Headers.Get("connection")
+	for _, option := range strings.Split(connection, ",") {
+		switch strings.ToLower(strings.TrimSpace(option)) {
+		case "close":
+			return false
+		case "keep-alive":
+			return true
+		}
+	}
+	return r.StatusLine.HttpVersion == "1.1"
+}
+
+// ResponseFromReader parses the status line and headers of a response to
+// a request with the given method. The body is parsed as Body is read,
+// so it can stream.
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	r := &Response{
+		state:    StateStatusLine,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		method:   method,
+		src:      reader,
+		buf:      make([]byte, 1024),
+	}
+	r.Body = &responseBody{r}
+	for r.state == StateStatusLine || r.state == StateHeaders {
+		n, err := r.parse(r.buf[:r.bufLen])
+		if err != nil {
+			return nil, err
+		}
+		r.consume(n)
+		if r.state != StateStatusLine && r.state != StateHeaders {
+			break
+		}
+		if err := r.fill(); err != nil {
+			if err == io.EOF && (r.bufLen > 0 || r.state != StateStatusLine) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type responseBody struct {
+	r *Response
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	r := b.r
+	if err := r.advance(); err != nil {
+		return 0, err
+	}
+	if r.state == StateDone {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if r.remaining >= 0 && int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	var n int
+	var err error
+	if r.bufLen > 0 {
+		n = copy(p, r.buf[:r.bufLen])
+		r.consume(n)
+	} else {
+		// nothing buffered, read straight into p
+		n, err = r.src.Read(p)
+	}
+
+	if r.remaining < 0 {
+		if err == io.EOF {
+			r.state = StateDone
+		}
+		return n, err
+	}
+	r.remaining -= int64(n)
+	if r.remaining == 0 {
+		r.state = StateDone
+		if r.chunked {
+			r.state = StateChunkEnd
+		}
+	}
+	if err == io.EOF {
+		if r.state == StateDone {
+			return n, nil
+		}
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -1,22 +1,73 @@
 package response
 
 import (
+	"bufio"
 	"fmt"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
 	"io"
+	"strconv"
+	"strings"
 )
 
-type Response struct {
-}
-
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols    StatusCode = 101
+	StatusOK                    StatusCode = 200
+	StatusCreated               StatusCode = 201
+	StatusNoContent             StatusCode = 204
+	StatusPartialContent        StatusCode = 206
+	StatusMovedPermanently      StatusCode = 301
+	StatusNotModified           StatusCode = 304
+	StatusBadRequest            StatusCode = 400
+	StatusForbidden             StatusCode = 403
+	StatusNotFound              StatusCode = 404
+	StatusMethodNotAllowed      StatusCode = 405
+	StatusPreconditionFailed    StatusCode = 412
+	StatusRequestEntityTooLarge StatusCode = 413
+	StatusUnsupportedMediaType  StatusCode = 415
+	StatusRangeNotSatisfiable   StatusCode = 416
+	StatusUnprocessableEntity   StatusCode = 422
+	StatusUpgradeRequired       StatusCode = 426
+	StatusHeaderFieldsTooLarge  StatusCode = 431
+	StatusInternalServerError   StatusCode = 500
+	StatusBadGateway            StatusCode = 502
+	StatusGatewayTimeout        StatusCode = 504
 )
 
+var statusText = map[StatusCode]string{
+	StatusSwitchingProtocols:    "Switching Protocols",
+	StatusOK:                    "OK",
+	StatusCreated:               "Created",
+	StatusNoContent:             "No Content",
+	StatusPartialContent:        "Partial Content",
+	StatusMovedPermanently:      "Moved Permanently",
+	StatusNotModified:           "Not Modified",
+	StatusBadRequest:            "Bad Request",
+	StatusForbidden:             "Forbidden",
+	StatusNotFound:              "Not Found",
+	StatusMethodNotAllowed:      "Method Not Allowed",
+	StatusPreconditionFailed:    "Precondition Failed",
+	StatusRequestEntityTooLarge: "Content Too Large",
+	StatusUnsupportedMediaType:  "Unsupported Media Type",
+	StatusRangeNotSatisfiable:   "Range Not Satisfiable",
+	StatusUnprocessableEntity:   "Unprocessable Content",
+	StatusUpgradeRequired:       "Upgrade Required",
+	StatusHeaderFieldsTooLarge:  "Request Header Fields Too Large",
+	StatusInternalServerError:   "Internal Server Error",
+	StatusBadGateway:            "Bad Gateway",
+	StatusGatewayTimeout:        "Gateway Timeout",
+}
+
+// TimeFormat is the IMF-fixdate format used by Date, Last-Modified etc.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// StatusText returns the reason phrase for a status code ("" if unknown)
+func StatusText(code StatusCode) string {
+	return statusText[code]
+}
+
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
@@ -26,6 +77,12 @@ func GetDefaultHeaders(contentLen int) *headers.Headers {
 	return h
 }
 
+var ERROR_CONTENT_LENGTH_EXCEEDED = fmt.Errorf("body is longer than the declared content-length")
+var ERROR_CONTENT_LENGTH_SHORT = fmt.Errorf("body is shorter than the declared content-length")
+
+// bodies up to this size are buffered so Content-Length can be computed
+const DefaultBufferSize = 8 * 1024
+
 // creating our own writer
 type writerState int
 
@@ -33,96 +90,327 @@ const (
 	stateStatusLine writerState = iota
 	stateHeaders
 	stateBody
+	stateTrailers
 	stateDone
+	stateHijacked
 )
 
 type Writer struct {
 	writer io.Writer
 	state  writerState
+
+	status StatusCode
+	header *headers.Headers
+
+	// buffered mode: the status line and headers are held back until the
+	// body is complete or bigger than bufferLimit, so the writer can pick
+	// the framing itself
+	bufferLimit int
+	buf         []byte
+	committed   bool
+
+	// framing of the committed response
+	chunked  bool
+	declared int // declared Content-Length, -1 if none
+	written  int
+
+	// body encoding, see SetCompression
+	compression *compression
+	encoder     Encoder
+
+	// request to validate against, see SetAutoETag
+	autoETag *request.Request
+
+	// HEAD responses send the headers only, see DiscardBody
+	noBody bool
+
+	serverName string
+
+	hijacker HijackFunc
+
+	// set by NewStreamWriter
+	stream Stream
 }
 
+// NewWriter returns a writer that sends the status line and headers as
+// soon as WriteHeaders is called. Framing is up to the handler.
 func NewWriter(writer io.Writer) *Writer {
-	return &Writer{writer: writer, state: stateStatusLine}
+	return &Writer{writer: writer, state: stateStatusLine, declared: -1}
+}
+
+// NewBufferedWriter returns a writer that keeps bodies of up to limit bytes
+// in memory and sets Content-Length for them. Bigger or streamed bodies
+// switch to chunked encoding. Call Finish when the handler is done.
+func NewBufferedWriter(writer io.Writer, limit int) *Writer {
+	// small chunks are coalesced until Flush or Finish
+	w := NewWriter(bufio.NewWriter(writer))
+	w.bufferLimit = limit
+	return w
+}
+
+// DiscardBody turns the response into the answer to a HEAD request: the
+// headers are the ones the GET would have had, including Content-Length,
+// but body writes are dropped while still reporting success
+func (w *Writer) DiscardBody() {
+	w.noBody = true
+}
+
+// bodyOut is where everything after the headers goes
+func (w *Writer) bodyOut(p []byte) (int, error) {
+	if w.noBody {
+		return len(p), nil
+	}
+	return w.writer.Write(p)
+}
+
+// Started reports whether the status line was written. From then on the
+// response can't be replaced by another one, e.g. an error.
+func (w *Writer) Started() bool {
+	return w.state != stateStatusLine
+}
+
+func (w *Writer) stateError(action string) error {
+	if w.state == stateHijacked {
+		return ERROR_HIJACKED
+	}
+	return fmt.Errorf("cannot %s in current state", action)
+}
+
+func (w *Writer) buffered() bool {
+	return w.bufferLimit > 0
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	if w.state != stateStatusLine {
-		return fmt.Errorf("cannot write status line in current state")
+		return w.stateError("write status line")
 	}
-	switch statusCode {
-	case StatusOK:
-		_, err := w.writer.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		w.state = stateHeaders
-		return err
-	case StatusBadRequest:
-		_, err := w.writer.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		w.state = stateHeaders
-		return err
-	case StatusInternalServerError:
-		_, err := w.writer.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
-		w.state = stateHeaders
-		return err
-	default:
-		return fmt.Errorf("Great, you found new Status. Unrecognized error code")
+	// any three digit code is valid on the wire, the reason phrase may be empty
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("invalid status code %d", statusCode)
 	}
+	w.status = statusCode
+	w.state = stateHeaders
+	return nil
 }
 
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	if w.state != stateHeaders {
-		return fmt.Errorf("cannot write headers in current state")
+		return w.stateError("write headers")
 	}
-	b := []byte{}
-	headers.ForEach(func(n, v string) {
+	w.header = headers.Clone()
+	w.state = stateBody
+	if w.buffered() && bodyAllowed(w.status) {
+		return nil
+	}
+	return w.commit(false)
+}
+
+// 1xx, 204 and 304 responses never carry a body
+func bodyAllowed(status StatusCode) bool {
+	return status >= 200 && status != StatusNoContent && status != StatusNotModified
+}
+
+func isChunked(h *headers.Headers) bool {
+	te, _ := h.Get("transfer-encoding")
+	return strings.Contains(strings.ToLower(te), "chunked")
+}
+
+// commit decides the framing and sends the status line and headers.
+// complete is true when the whole body is in w.buf.
+func (w *Writer) commit(complete bool) error {
+	if w.committed {
+		return nil
+	}
+	w.committed = true
+
+	// validators are about the identity body, the encoding derives its
+	// own ETag from them and a 304 has nothing left to encode
+	if complete {
+		w.applyAutoETag()
+	}
+	if err := w.setupEncoding(complete); err != nil {
+		return err
+	}
+	if w.stream != nil {
+		for _, name := range connectionHeaders {
+			w.header.Delete(name)
+		}
+	}
+
+	_, hasLength := w.header.Get("content-length")
+	switch {
+	case !bodyAllowed(w.status):
+	case isChunked(w.header):
+		w.chunked = true
+		w.header.Delete("content-length")
+	case hasLength:
+		w.declared = headers.GetInt(w.header, "content-length", -1)
+	case complete && w.announcedTrailers() == nil:
+		w.declared = len(w.buf)
+		w.header.Set("Content-Length", strconv.Itoa(len(w.buf)))
+	case w.buffered() && w.stream == nil:
+		w.chunked = true
+		w.header.Set("Transfer-Encoding", "chunked")
+	}
+	// otherwise the body is delimited by closing the connection
+
+	w.addDefaultHeaders()
+
+	if w.stream != nil {
+		if err := w.writeStreamHead(complete); err != nil {
+			return err
+		}
+		return w.writeBuffered()
+	}
+
+	b := fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", w.status, StatusText(w.status))
+	w.header.ForEach(func(n, v string) {
 		b = fmt.Appendf(b, "%s: %s\r\n", n, v)
 	})
 	b = fmt.Append(b, "\r\n")
-	_, err := w.writer.Write(b)
-	w.state = stateBody
-	return err
+	if _, err := w.writer.Write(b); err != nil {
+		return err
+	}
+	return w.writeBuffered()
+}
+
+// writeBuffered sends the body held back until commit
+func (w *Writer) writeBuffered() error {
+	body := w.buf
+	w.buf = nil
+	if len(body) > 0 {
+		if _, err := w.writeBodyBytes(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFramed writes body bytes using the committed framing
+func (w *Writer) writeFramed(p []byte) (int, error) {
+	if w.chunked {
+		return w.writeChunk(p)
+	}
+	if w.declared >= 0 && w.written+len(p) > w.declared {
+		return 0, ERROR_CONTENT_LENGTH_EXCEEDED
+	}
+	n, err := w.bodyOut(p)
+	w.written += n
+	return n, err
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.state != stateBody {
-		return 0, fmt.Errorf("cannot write body in current state")
+		return 0, w.stateError("write body")
 	}
-	n, err := w.writer.Write(p)
-	return n, err
+	if !bodyAllowed(w.status) {
+		return 0, fmt.Errorf("status %d does not allow a body", w.status)
+	}
+	if w.committed {
+		return w.writeBodyBytes(p)
+	}
+
+	if _, hasLength := w.header.Get("content-length"); hasLength {
+		declared := headers.GetInt(w.header, "content-length", -1)
+		if len(w.buf)+len(p) > declared {
+			return 0, ERROR_CONTENT_LENGTH_EXCEEDED
+		}
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.bufferLimit {
+		if err := w.commit(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != stateBody {
-		return 0, fmt.Errorf("cannot write chunked body in current state")
+		return 0, w.stateError("write chunked body")
+	}
+	if !w.committed {
+		// explicit chunks mean the handler is streaming
+		w.header.Delete("content-length")
+		w.header.Set("Transfer-Encoding", "chunked")
+		if err := w.commit(false); err != nil {
+			return 0, err
+		}
+	}
+	if w.encoder != nil {
+		// keep the chunk boundary the handler asked for
+		n, err := w.encoder.Write(p)
+		if err != nil {
+			return n, err
+		}
+		return n, w.encoder.Flush()
+	}
+	if w.stream != nil {
+		return w.writeFramed(p)
+	}
+	return w.writeChunk(p)
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	// a zero-length chunk would end the body
+	n := len(p)
+	if n == 0 {
+		return 0, nil
 	}
 
 	// writing chunk size in hex
-	n := len(p)
-	_, err := w.writer.Write([]byte(fmt.Sprintf("%x\r\n", n)))
+	_, err := w.bodyOut([]byte(fmt.Sprintf("%x\r\n", n)))
 	if err != nil {
 		return 0, err
 	}
 
 	// write the chunk itself
-	_, err = w.writer.Write(p)
+	_, err = w.bodyOut(p)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 
 	// CRLF after chunk
-	_, err = w.writer.Write([]byte("\r\n"))
+	_, err = w.bodyOut([]byte("\r\n"))
 	if err != nil {
 		return 0, err
 	}
 
 	// return length of data
+	w.written += n
 	return n, nil
 }
+
+// WriteChunkedBodyDone writes the last chunk. When the headers announced
+// trailers, the writer then waits for WriteTrailers instead of ending the
+// response right away.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.state != stateBody {
-		return 0, fmt.Errorf("cannot finish chunked body in current state")
+		return 0, w.stateError("finish chunked body")
+	}
+	if err := w.commit(false); err != nil {
+		return 0, err
+	}
+	if w.stream != nil {
+		return 0, w.endStream()
+	}
+	// a terminator in a Content-Length or close delimited body would be
+	// taken as body bytes, or as the start of the next response
+	if !w.chunked {
+		return 0, fmt.Errorf("cannot finish chunked body: the body is not chunked")
+	}
+	if err := w.closeEncoder(); err != nil {
+		return 0, err
+	}
+
+	if w.announcedTrailers() != nil {
+		n, err := w.bodyOut([]byte("0\r\n"))
+		w.state = stateTrailers
+		return n, err
 	}
 
 	// write final zero-length chunk
-	n, err := w.writer.Write([]byte("0\r\n\r\n"))
+	n, err := w.bodyOut([]byte("0\r\n\r\n"))
 	if err != nil {
 		return n, err
 	}
@@ -131,3 +419,186 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	w.state = stateDone
 	return n, nil
 }
+
+// trailer field names from the Trailer header, nil if there is none
+func (w *Writer) announcedTrailers() map[string]bool {
+	if w.header == nil {
+		return nil
+	}
+	value, ok := w.header.Get("trailer")
+	if !ok {
+		return nil
+	}
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// fields that are about framing, routing or auth can't be trailers
+var forbiddenTrailers = map[string]bool{
+	"content-length":    true,
+	"transfer-encoding": true,
+	"content-encoding":  true,
+	"content-type":      true,
+	"content-range":     true,
+	"host":              true,
+	"trailer":           true,
+	"authorization":     true,
+	"set-cookie":        true,
+	"cache-control":     true,
+}
+
+// WriteTrailers ends a chunked body with trailer fields. Every field must
+// have been announced in the Trailer header.
+func (w *Writer) WriteTrailers(trailers headers.Headers) error {
+	if w.state == stateBody {
+		if err := w.commit(false); err != nil {
+			return err
+		}
+		if !w.chunked && w.stream == nil {
+			return fmt.Errorf("trailers need a chunked body")
+		}
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
+	if w.state != stateTrailers {
+		return w.stateError("write trailers")
+	}
+
+	announced := w.announcedTrailers()
+	var err error
+	b := []byte{}
+	trailers.ForEach(func(n, v string) {
+		if forbiddenTrailers[n] {
+			err = fmt.Errorf("%s is not allowed as a trailer", n)
+		} else if !announced[n] {
+			err = fmt.Errorf("trailer %s was not announced in the Trailer header", n)
+		}
+		b = fmt.Appendf(b, "%s: %s\r\n", n, v)
+	})
+	if err != nil {
+		return err
+	}
+	w.state = stateDone
+	if w.stream != nil {
+		return w.stream.Close(&trailers)
+	}
+	b = fmt.Append(b, "\r\n")
+	_, err = w.bodyOut(b)
+	return err
+}
+
+// Finish completes the response: it sends anything still buffered with a
+// computed Content-Length, ends chunked bodies and reports bodies shorter
+// than the declared Content-Length.
+func (w *Writer) Finish() error {
+	if w.state == stateHijacked {
+		return nil
+	}
+	if err := w.finish(); err != nil {
+		return err
+	}
+	return w.flushWriter()
+}
+
+func (w *Writer) finish() error {
+	switch w.state {
+	case stateStatusLine, stateDone, stateHijacked:
+		return nil
+	case stateHeaders:
+		if err := w.WriteHeaders(*headers.NewHeaders()); err != nil {
+			return err
+		}
+	case stateTrailers:
+		// trailers were announced but never written
+		return w.WriteTrailers(*headers.NewHeaders())
+	}
+
+	if err := w.commit(true); err != nil {
+		return err
+	}
+	if w.chunked || w.stream != nil {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		if w.state == stateTrailers {
+			return w.WriteTrailers(*headers.NewHeaders())
+		}
+		return nil
+	}
+
+	if err := w.closeEncoder(); err != nil {
+		return err
+	}
+	w.state = stateDone
+	if w.declared >= 0 && w.written < w.declared && !w.noBody {
+		return ERROR_CONTENT_LENGTH_SHORT
+	}
+	return nil
+}
+
+// Write makes the body an io.Writer. The framing follows the headers:
+// chunks for chunked responses, raw bytes otherwise.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
+// ReadFrom copies r into the body so io.Copy can stream into the writer.
+// Once the headers are out every read is flushed, so streamed sources
+// reach the client as they arrive.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			written, err := w.Write(buf[:n])
+			total += int64(written)
+			if err != nil {
+				return total, err
+			}
+			if w.committed {
+				if err := w.Flush(); err != nil {
+					return total, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return total, nil
+		}
+		if readErr != nil {
+			return total, readErr
+		}
+	}
+}
+
+// Flush sends the headers and everything written so far to the client.
+// A buffered response without a Content-Length becomes chunked.
+func (w *Writer) Flush() error {
+	if w.state == stateHijacked {
+		return ERROR_HIJACKED
+	}
+	if w.state == stateBody {
+		if err := w.commit(false); err != nil {
+			return err
+		}
+		if w.encoder != nil {
+			if err := w.encoder.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return w.flushWriter()
+}
+
+func (w *Writer) flushWriter() error {
+	if f, ok := w.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,543 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedWriter(t *testing.T) {
+	// Test: small body gets a computed Content-Length
+	var out bytes.Buffer
+	w := NewBufferedWriter(&out, 16)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*headers.NewHeaders()))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Empty(t, out.String())
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out.String(), "content-length: 5\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nhello"))
+
+	// Test: body over the limit switches to chunked
+	out.Reset()
+	w = NewBufferedWriter(&out, 4)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*headers.NewHeaders()))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("!"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, out.String(), "content-length")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n5\r\nhello\r\n1\r\n!\r\n0\r\n\r\n"))
+
+	// Test: writing more than the declared length fails
+	out.Reset()
+	w = NewBufferedWriter(&out, 16)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "3")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = w.WriteBody([]byte("hello"))
+	assert.ErrorIs(t, err, ERROR_CONTENT_LENGTH_EXCEEDED)
+
+	// Test: same check without buffering
+	out.Reset()
+	w = NewWriter(&out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("there"))
+	assert.ErrorIs(t, err, ERROR_CONTENT_LENGTH_EXCEEDED)
+	assert.ErrorIs(t, w.Finish(), ERROR_CONTENT_LENGTH_SHORT)
+
+	// Test: no chunk terminator in a Content-Length body
+	out.Reset()
+	w = NewWriter(&out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = w.WriteBody([]byte("hey"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	assert.Error(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nhey"))
+}
+
+func TestWriterIOCopyAndFlush(t *testing.T) {
+	// Test: Flush commits a buffered response as chunked
+	var out bytes.Buffer
+	w := NewBufferedWriter(&out, 1024)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*headers.NewHeaders()))
+	_, err := w.Write([]byte("first"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "5\r\nfirst\r\n"))
+
+	// Test: io.Copy goes through ReadFrom (strings.Reader alone would use WriteTo)
+	_, err = io.Copy(w, struct{ io.Reader }{strings.NewReader("second")})
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out.String(), "6\r\nsecond\r\n"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(out.String(), "0\r\n\r\n"))
+
+	// Test: io.Copy with a declared length writes raw bytes
+	out.Reset()
+	w = NewBufferedWriter(&out, 1024)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "6")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = io.Copy(w, strings.NewReader("stream"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nstream"))
+}
+
+func TestWriteTrailers(t *testing.T) {
+	// Test: announced trailer after a chunked body
+	var out bytes.Buffer
+	w := NewBufferedWriter(&out, 1024)
+	h := headers.NewHeaders()
+	h.Set("Trailer", "X-Content-SHA256")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-SHA256", "abc")
+	require.NoError(t, w.WriteTrailers(*trailers))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "5\r\nhello\r\n0\r\nx-content-sha256: abc\r\n\r\n"))
+
+	// Test: trailer that was not announced
+	out.Reset()
+	w = NewBufferedWriter(&out, 1024)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Other", "1")
+	require.Error(t, w.WriteTrailers(*trailers))
+
+	// Test: trailers on a Content-Length response
+	out.Reset()
+	w = NewBufferedWriter(&out, 1024)
+	h = headers.NewHeaders()
+	h.Set("Content-Length", "0")
+	h.Set("Trailer", "X-Other")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	require.Error(t, w.WriteTrailers(*trailers))
+
+	// Test: announced trailers that are never written still end the body
+	out.Reset()
+	w = NewBufferedWriter(&out, 1024)
+	h = headers.NewHeaders()
+	h.Set("Trailer", "X-Other")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n0\r\n\r\n"))
+}
+
+func TestParseRange(t *testing.T) {
+	ranges, err := ParseRange("bytes=0-4, 10-, -3", 20)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{0, 5}, {10, 10}, {17, 3}}, ranges)
+
+	// Test: end past the size is clamped
+	ranges, err = ParseRange("bytes=15-100", 20)
+	require.NoError(t, err)
+	assert.Equal(t, []ByteRange{{15, 5}}, ranges)
+
+	// Test: nothing overlaps
+	_, err = ParseRange("bytes=20-30", 20)
+	assert.ErrorIs(t, err, ERROR_RANGE_NOT_SATISFIABLE)
+
+	// Test: garbage is ignored rather than refused
+	_, err = ParseRange("bytes=5-1", 20)
+	assert.ErrorIs(t, err, ERROR_INVALID_RANGE)
+	_, err = ParseRange("items=0-1", 20)
+	assert.ErrorIs(t, err, ERROR_INVALID_RANGE)
+}
+
+func serveContent(t *testing.T, rawRequest string, h *headers.Headers) string {
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	w := NewBufferedWriter(&out, DefaultBufferSize)
+	content := strings.NewReader("0123456789abcdefghij")
+	modtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, ServeContent(w, req, "data.txt", modtime, content, h))
+	require.NoError(t, w.Finish())
+	return out.String()
+}
+
+func TestServeContent(t *testing.T) {
+	// Test: no Range
+	out := serveContent(t, "GET / HTTP/1.1\r\n\r\n", nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "accept-ranges: bytes\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n0123456789abcdefghij"))
+
+	// Test: single range
+	out = serveContent(t, "GET / HTTP/1.1\r\nRange: bytes=2-5\r\n\r\n", nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, out, "content-range: bytes 2-5/20\r\n")
+	assert.Contains(t, out, "content-length: 4\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n2345"))
+
+	// Test: unsatisfiable
+	out = serveContent(t, "GET / HTTP/1.1\r\nRange: bytes=50-\r\n\r\n", nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, out, "content-range: bytes */20\r\n")
+
+	// Test: several ranges as multipart/byteranges
+	out = serveContent(t, "GET / HTTP/1.1\r\nRange: bytes=0-1,-2\r\n\r\n", nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	head, body, _ := strings.Cut(out, "\r\n\r\n")
+	_, boundary, ok := strings.Cut(head, "multipart/byteranges; boundary=")
+	require.True(t, ok)
+	boundary, _, _ = strings.Cut(boundary, "\r\n")
+	assert.Contains(t, head+"\r\n", "content-length: "+strconv.Itoa(len(body))+"\r\n")
+
+	mr := request.NewMultipartReader(strings.NewReader(body), boundary)
+	expected := []struct{ contentRange, data string }{
+		{"bytes 0-1/20", "01"},
+		{"bytes 18-19/20", "ij"},
+	}
+	for _, e := range expected {
+		part, err := mr.NextPart()
+		require.NoError(t, err)
+		contentRange, _ := part.Header.Get("content-range")
+		assert.Equal(t, e.contentRange, contentRange)
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, e.data, string(data))
+	}
+	_, err := mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: If-Range with the current date honors the range, an old one does not
+	out = serveContent(t, "GET / HTTP/1.1\r\nRange: bytes=0-1\r\nIf-Range: Tue, 02 Jan 2024 03:04:05 GMT\r\n\r\n", nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	out = serveContent(t, "GET / HTTP/1.1\r\nRange: bytes=0-1\r\nIf-Range: Mon, 01 Jan 2024 00:00:00 GMT\r\n\r\n", nil)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: If-Range with an entity tag
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+	out = serveContent(t, "GET / HTTP/1.1\r\nRange: bytes=0-1\r\nIf-Range: \"v1\"\r\n\r\n", h)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	out = serveContent(t, "GET / HTTP/1.1\r\nRange: bytes=0-1\r\nIf-Range: \"v0\"\r\n\r\n", h)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+}
+
+func conditionalRequest(t *testing.T, method string, fields ...string) *request.Request {
+	raw := method + " / HTTP/1.1\r\n"
+	for _, f := range fields {
+		raw += f + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v2"`)
+	modtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		method string
+		fields []string
+		want   StatusCode
+	}{
+		{"GET", nil, 0},
+		{"GET", []string{`If-None-Match: "v1", W/"v2"`}, StatusNotModified},
+		{"GET", []string{`If-None-Match: "v1"`}, 0},
+		{"GET", []string{"If-None-Match: *"}, StatusNotModified},
+		{"PUT", []string{`If-None-Match: "v2"`}, StatusPreconditionFailed},
+		{"PUT", []string{`If-Match: "v1"`}, StatusPreconditionFailed},
+		{"PUT", []string{`If-Match: W/"v2"`}, StatusPreconditionFailed},
+		{"PUT", []string{`If-Match: "v1", "v2"`}, 0},
+		{"GET", []string{"If-Modified-Since: Tue, 02 Jan 2024 03:04:05 GMT"}, StatusNotModified},
+		{"GET", []string{"If-Modified-Since: Mon, 01 Jan 2024 00:00:00 GMT"}, 0},
+		{"PUT", []string{"If-Unmodified-Since: Mon, 01 Jan 2024 00:00:00 GMT"}, StatusPreconditionFailed},
+		// If-None-Match wins over If-Modified-Since
+		{"GET", []string{`If-None-Match: "v1"`, "If-Modified-Since: Tue, 02 Jan 2024 03:04:05 GMT"}, 0},
+		// If-Match wins over If-Unmodified-Since
+		{"PUT", []string{`If-Match: "v2"`, "If-Unmodified-Since: Mon, 01 Jan 2024 00:00:00 GMT"}, 0},
+	}
+	for _, c := range cases {
+		req := conditionalRequest(t, c.method, c.fields...)
+		assert.Equal(t, c.want, CheckPreconditions(req, h, modtime), "%s %v", c.method, c.fields)
+	}
+
+	// Test: the tag of a gzipped copy revalidates too, and is sent back
+	req := conditionalRequest(t, "GET", `If-None-Match: "v2-gzip"`)
+	assert.Equal(t, StatusNotModified, CheckPreconditions(req, h, modtime))
+	etag, _ := h.Get("etag")
+	assert.Equal(t, `"v2-gzip"`, etag)
+}
+
+func TestAutoETag(t *testing.T) {
+	encoding := ""
+	serve := func(req *request.Request) string {
+		var out bytes.Buffer
+		w := NewBufferedWriter(&out, DefaultBufferSize)
+		w.SetAutoETag(req)
+		if encoding != "" {
+			require.NoError(t, w.SetCompression(encoding, 0))
+		}
+		h := GetDefaultHeaders(0)
+		h.Delete("content-length")
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		require.NoError(t, w.WriteHeaders(*h))
+		_, err := w.WriteBody([]byte("cache me"))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		return out.String()
+	}
+
+	// Test: the body hash becomes the ETag
+	out := serve(conditionalRequest(t, "GET"))
+	etag := ETagFor([]byte("cache me"))
+	assert.Contains(t, out, "etag: "+etag+"\r\n")
+
+	// Test: a matching If-None-Match gets a bare 304
+	out = serve(conditionalRequest(t, "GET", "If-None-Match: "+etag))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out, "etag: "+etag+"\r\n")
+	assert.NotContains(t, out, "content-type")
+	assert.NotContains(t, out, "content-length")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: ServeContent answers with 304 as well
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+	out = serveContent(t, "GET / HTTP/1.1\r\nIf-None-Match: \"v1\"\r\n\r\n", h)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.NotContains(t, out, "accept-ranges")
+
+	// Test: a compressed body is hashed before encoding and tagged apart
+	encoding = "gzip"
+	out = serve(conditionalRequest(t, "GET"))
+	assert.Contains(t, out, "content-encoding: gzip\r\n")
+	assert.Contains(t, out, "etag: "+encodedETag(etag, "gzip")+"\r\n")
+
+	// Test: revalidating either tag is a 304 with nothing encoded
+	for _, tag := range []string{etag, encodedETag(etag, "gzip")} {
+		out = serve(conditionalRequest(t, "GET", "If-None-Match: "+tag))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"), tag)
+		assert.Contains(t, out, "etag: "+tag+"\r\n")
+		assert.NotContains(t, out, "content-encoding")
+	}
+}
+
+func TestDiscardBody(t *testing.T) {
+	// Test: buffered body keeps its Content-Length but is not sent
+	var out bytes.Buffer
+	w := NewBufferedWriter(&out, 16)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*headers.NewHeaders()))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "content-length: 5\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n"))
+
+	// Test: chunked bodies send no chunks and no terminator
+	out.Reset()
+	w = NewBufferedWriter(&out, 16)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*headers.NewHeaders()))
+	n, err = w.WriteChunkedBody([]byte("streamed"))
+	require.NoError(t, err)
+	assert.Equal(t, 8, n)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n"))
+	assert.NotContains(t, out.String(), "streamed")
+
+	// Test: a declared length without a body is fine for HEAD
+	out.Reset()
+	w = NewWriter(&out)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(42)))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "content-length: 42\r\n")
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	// Test: Date and Server are added
+	var out bytes.Buffer
+	w := NewBufferedWriter(&out, 16)
+	w.SetServerName("httpfromtcp")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "server: httpfromtcp\r\n")
+	_, date, ok := strings.Cut(out.String(), "date: ")
+	require.True(t, ok)
+	date, _, _ = strings.Cut(date, "\r\n")
+	parsed, err := time.Parse(TimeFormat, date)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), parsed, 2*time.Second)
+
+	// Test: handler values win
+	out.Reset()
+	w = NewBufferedWriter(&out, 16)
+	w.SetServerName("httpfromtcp")
+	h := headers.NewHeaders()
+	h.Set("Date", "Tue, 02 Jan 2024 03:04:05 GMT")
+	h.Set("Server", "custom")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "date: Tue, 02 Jan 2024 03:04:05 GMT\r\n")
+	assert.Contains(t, out.String(), "server: custom\r\n")
+}
+
+// chunkReader hands out at most numBytesPerRead bytes per Read, like a
+// network connection that delivers the response in pieces
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func readResponse(t *testing.T, data string, numBytesPerRead int, method string) (*Response, string) {
+	r, err := ResponseFromReader(&chunkReader{data: data, numBytesPerRead: numBytesPerRead}, method)
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.True(t, r.Done())
+	return r, string(body)
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: status line, headers and a Content-Length body
+	r, body := readResponse(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 13\r\n\r\nHello World!\n", 3, "GET")
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+	contentType, _ := r.Headers.Get("content-type")
+	assert.Equal(t, "text/plain", contentType)
+	assert.Equal(t, "Hello World!\n", body)
+
+	// Test: chunked body with extensions and trailers, one byte at a time
+	r, body = readResponse(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n"+
+		"6;ext=1\r\nhello \r\nb\r\nfrom chunks\r\n0\r\nX-Checksum: abc\r\n\r\n", 1, "GET")
+	assert.Equal(t, "hello from chunks", body)
+	checksum, _ := r.Trailers.Get("x-checksum")
+	assert.Equal(t, "abc", checksum)
+
+	// Test: without framing the body runs to the end of the stream
+	_, body = readResponse(t, "HTTP/1.0 200 OK\r\n\r\nuntil close", 4, "GET")
+	assert.Equal(t, "until close", body)
+
+	// Test: interim responses are skipped
+	r, body = readResponse(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\n"+
+		"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok", 5, "POST")
+	assert.Equal(t, StatusCreated, r.StatusLine.StatusCode)
+	_, hasLink := r.Headers.Get("link")
+	assert.False(t, hasLink)
+	assert.Equal(t, "ok", body)
+
+	// Test: HEAD, 204 and 304 have no body whatever the headers say
+	for _, c := range []struct{ head, method string }{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", "HEAD"},
+		{"HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\n", "GET"},
+		{"HTTP/1.1 304 Not Modified\r\nTransfer-Encoding: chunked\r\n\r\n", "GET"},
+	} {
+		r, body = readResponse(t, c.head, 7, c.method)
+		assert.Equal(t, "", body, c.head)
+		assert.Empty(t, r.Unread())
+	}
+
+	// Test: an empty reason phrase, and bytes after the body stay unread
+	r, body = readResponse(t, "HTTP/1.1 299 \r\nContent-Length: 2\r\n\r\nokHTTP/1.1", 64, "GET")
+	assert.Equal(t, StatusCode(299), r.StatusLine.StatusCode)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, "HTTP/1.1", string(r.Unread()))
+
+	// Test: what the Writer sends parses back
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(*h)
+	w.WriteChunkedBody([]byte("streamed"))
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailers(*trailers))
+	r, body = readResponse(t, buf.String(), 2, "GET")
+	assert.Equal(t, "streamed", body)
+	sum, _ := r.Trailers.Get("x-sum")
+	assert.Equal(t, "1", sum)
+}
+
+func TestResponseFromReaderErrors(t *testing.T) {
+	// Test: broken status lines
+	for _, line := range []string{"HTTP/2 200 OK", "HTTP/1.1 20 OK", "HTTP/1.1 abc OK", "200 OK", "HTTP/1.1"} {
+		_, err := ResponseFromReader(strings.NewReader(line+"\r\n\r\n"), "GET")
+		assert.ErrorIs(t, err, ERROR_MALFORMED_STATUS_LINE, line)
+	}
+
+	// Test: the stream ends in the middle of the head
+	_, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-"), "GET")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: unknown framing
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\n"), "GET")
+	assert.ErrorIs(t, err, ERROR_INVALID_FRAMING)
+
+	// Test: body errors show up when reading it
+	for _, c := range []struct {
+		data string
+		err  error
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort", io.ErrUnexpectedEOF},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", ERROR_MALFORMED_CHUNK},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nokXY\r\n", ERROR_MALFORMED_CHUNK},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n", io.ErrUnexpectedEOF},
+	} {
+		r, err := ResponseFromReader(&chunkReader{data: c.data, numBytesPerRead: 3}, "GET")
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		assert.ErrorIs(t, err, c.err, c.data)
+	}
+}
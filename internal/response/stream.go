@@ -0,0 +1,65 @@
+package response
+
+import (
+	"httpfromtcp/internal/headers"
+)
+
+// Stream carries a response over a protocol with its own framing, like an
+// HTTP/2 stream. The Writer hands it the head and the body bytes instead
+// of writing HTTP/1.1 to a connection.
+type Stream interface {
+	// WriteHead sends the status and headers, endStream means no body
+	// follows
+	WriteHead(status StatusCode, h *headers.Headers, endStream bool) error
+	// Write sends body bytes
+	Write(p []byte) (int, error)
+	// Close ends the stream, with trailers unless they are nil. It is a
+	// no-op once the stream has ended.
+	Close(trailers *headers.Headers) error
+}
+
+// fields that only make sense for one HTTP/1.1 connection, RFC 9113 8.2.2
+var connectionHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// NewStreamWriter returns a buffered writer (see NewBufferedWriter) that
+// sends the response on s. Framing is up to the stream, so chunked
+// encoding and the HTTP/1.1 connection headers are dropped.
+func NewStreamWriter(s Stream, limit int) *Writer {
+	w := NewWriter(s)
+	w.stream = s
+	w.bufferLimit = limit
+	return w
+}
+
+// writeStreamHead is commit for streams
+func (w *Writer) writeStreamHead(complete bool) error {
+	endStream := !bodyAllowed(w.status) && w.status >= 200 ||
+		complete && (len(w.buf) == 0 || w.noBody) && w.announcedTrailers() == nil
+	if err := w.stream.WriteHead(w.status, w.header, endStream); err != nil {
+		return err
+	}
+	if endStream {
+		w.buf = nil
+	}
+	return nil
+}
+
+// endStream finishes the body on a stream, with trailers if the headers
+// announced them
+func (w *Writer) endStream() error {
+	if err := w.closeEncoder(); err != nil {
+		return err
+	}
+	if w.announcedTrailers() != nil {
+		w.state = stateTrailers
+		return nil
+	}
+	w.state = stateDone
+	return w.stream.Close(nil)
+}
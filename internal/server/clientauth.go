@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/x509"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+)
+
+// ClientRule says which client certificates may pass RequireClientCert.
+// A certificate matches when any listed value matches, an empty rule lets
+// every verified certificate through.
+type ClientRule struct {
+	// Subjects match the common name or the whole subject, e.g.
+	// "CN=billing,O=internal"
+	Subjects []string
+	// DNSNames match the DNS SANs, "*.svc.internal" matches one label
+	DNSNames []string
+	// URIs match URI SANs exactly, e.g. SPIFFE IDs
+	URIs []string
+	// Emails match email SANs exactly
+	Emails []string
+}
+
+func (rule ClientRule) empty() bool {
+	return len(rule.Subjects) == 0 && len(rule.DNSNames) == 0 && len(rule.URIs) == 0 && len(rule.Emails) == 0
+}
+
+// Matches reports whether cert is allowed by the rule
+func (rule ClientRule) Matches(cert *x509.Certificate) bool {
+	if rule.empty() {
+		return true
+	}
+	for _, subject := range rule.Subjects {
+		if subject == cert.Subject.CommonName || subject == cert.Subject.String() {
+			return true
+		}
+	}
+	for _, pattern := range rule.DNSNames {
+		for _, name := range cert.DNSNames {
+			if matchDNSName(pattern, name) {
+				return true
+			}
+		}
+	}
+	for _, want := range rule.URIs {
+		for _, uri := range cert.URIs {
+			if uri.String() == want {
+				return true
+			}
+		}
+	}
+	for _, want := range rule.Emails {
+		for _, email := range cert.EmailAddresses {
+			if strings.EqualFold(email, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchDNSName(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(name, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == name
+}
+
+// RequireClientCert only lets requests with a verified client certificate
+// matching rule through to next, everything else gets a 403. Pair it with
+// ClientAuthOptional to protect some routes only.
+func RequireClientCert(rule ClientRule, next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		cert := req.ClientCertificate()
+		if cert == nil {
+			(&HandlerError{StatusCode: response.StatusForbidden, Message: "client certificate required"}).Write(w)
+			return
+		}
+		if !rule.Matches(cert) {
+			(&HandlerError{StatusCode: response.StatusForbidden, Message: "client certificate not allowed"}).Write(w)
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue signs a client certificate
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, dnsNames []string, uris ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// mtlsGet sends a request presenting cert (nil for none) and returns the
+// raw response
+func mtlsGet(addr string, cert *tls.Certificate) (string, error) {
+	config := &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")); err != nil {
+		return "", err
+	}
+	// with TLS 1.3 a rejected certificate only shows up on the first read
+	out, err := io.ReadAll(conn)
+	return string(out), err
+}
+
+func serveMTLS(t *testing.T, mode ClientAuthMode, pool *x509.CertPool, h Handler) string {
+	serverCert := writeCert(t, t.TempDir(), "server", "server", "localhost")
+	s, err := ServeWithOptions(0, h, Options{TLS: &TLSOptions{
+		Certificates: []CertificateFiles{serverCert},
+		ClientAuth:   mode,
+		ClientCAs:    pool,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+func whoami(w *response.Writer, req *request.Request) {
+	body := "anonymous"
+	if cert := req.ClientCertificate(); cert != nil {
+		body = cert.Subject.String()
+	}
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	billing := ca.issue(t, pkix.Name{CommonName: "billing", Organization: []string{"internal"}},
+		[]string{"billing.svc.internal"}, "spiffe://internal/billing")
+	rogue := newTestCA(t).issue(t, pkix.Name{CommonName: "billing"}, nil)
+
+	// Test: required mode checks the chain during the handshake
+	addr := serveMTLS(t, ClientAuthRequired, ca.pool(), whoami)
+	out, err := mtlsGet(addr, &billing)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nCN=billing,O=internal"))
+	_, err = mtlsGet(addr, nil)
+	assert.Error(t, err)
+	_, err = mtlsGet(addr, &rogue)
+	assert.Error(t, err)
+
+	// Test: optional mode lets anonymous clients in, bad chains still fail
+	addr = serveMTLS(t, ClientAuthOptional, ca.pool(), whoami)
+	out, err = mtlsGet(addr, nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nanonymous"))
+	_, err = mtlsGet(addr, &rogue)
+	assert.Error(t, err)
+
+	// Test: the middleware matches on subject or SAN
+	for _, c := range []struct {
+		name   string
+		rule   ClientRule
+		cert   *tls.Certificate
+		status string
+	}{
+		{"no certificate", ClientRule{}, nil, "403"},
+		{"any verified", ClientRule{}, &billing, "200"},
+		{"common name", ClientRule{Subjects: []string{"billing"}}, &billing, "200"},
+		{"full subject", ClientRule{Subjects: []string{"CN=billing,O=internal"}}, &billing, "200"},
+		{"dns wildcard", ClientRule{DNSNames: []string{"*.svc.internal"}}, &billing, "200"},
+		{"dns wildcard one label", ClientRule{DNSNames: []string{"*.internal"}}, &billing, "403"},
+		{"uri", ClientRule{URIs: []string{"spiffe://internal/billing"}}, &billing, "200"},
+		{"no match", ClientRule{Subjects: []string{"payments"}, URIs: []string{"spiffe://internal/payments"}}, &billing, "403"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			addr := serveMTLS(t, ClientAuthOptional, ca.pool(), RequireClientCert(c.rule, whoami))
+			out, err := mtlsGet(addr, c.cert)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 "+c.status+" "), out)
+		})
+	}
+
+	// Test: client auth without a CA pool is a configuration error
+	serverCert := writeCert(t, t.TempDir(), "server", "server", "localhost")
+	_, err = ServeWithOptions(0, whoami, Options{TLS: &TLSOptions{
+		Certificates: []CertificateFiles{serverCert},
+		ClientAuth:   ClientAuthRequired,
+	}})
+	require.ErrorIs(t, err, ERROR_NO_CLIENT_CAS)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+func (he *HandlerError) Error() string {
+	return he.Message
+}
+
+// Problem converts the error into an RFC 9457 problem details object
+func (he *HandlerError) Problem() response.Problem {
+	return response.Problem{
+		Status: he.StatusCode,
+		Detail: he.Message,
+	}
+}
+
+// Write sends the error to the client as application/problem+json
+func (he *HandlerError) Write(w *response.Writer) error {
+	return w.WriteProblemWithHeaders(he.Problem(), he.Headers)
+}
+
+// ErrorHandler is a Handler that can give up by returning an error
+type ErrorHandler func(w *response.Writer, req *request.Request) error
+
+// HandleErrors turns an ErrorHandler into a Handler.
+// A returned *HandlerError is written as is, anything else becomes a 500
+// so internal details don't leak to the client. An error after the
+// response started can't be sent anymore: it is logged and the connection
+// aborted.
+func HandleErrors(h ErrorHandler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		err := h(w, req)
+		if err == nil {
+			return
+		}
+		if w.Started() {
+			fmt.Println("handler error: ", err)
+			w.Abort()
+			return
+		}
+
+		var he *HandlerError
+		if !errors.As(err, &he) {
+			he = &HandlerError{
+				StatusCode: response.StatusInternalServerError,
+				Message:    "internal server error",
+			}
+		}
+		he.Write(w)
+	}
+}
+
+// DecodeError maps the errors of request.DecodeJSON and
+// request.DecodeBody to a HandlerError
+func DecodeError(err error) *HandlerError {
+	status := response.StatusBadRequest
+	switch {
+	case errors.Is(err, request.ERROR_UNSUPPORTED_MEDIA_TYPE):
+		status = response.StatusUnsupportedMediaType
+	case errors.Is(err, request.ERROR_BODY_TOO_LARGE):
+		status = response.StatusRequestEntityTooLarge
+	}
+	return &HandlerError{StatusCode: status, Message: err.Error()}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleErrors(t *testing.T) {
+	run := func(h ErrorHandler) string {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		var out bytes.Buffer
+		HandleErrors(h)(response.NewWriter(&out), req)
+		return out.String()
+	}
+
+	// Test: a HandlerError is sent as a problem
+	out := run(func(w *response.Writer, req *request.Request) error {
+		return &HandlerError{StatusCode: response.StatusNotFound, Message: "no such thing"}
+	})
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "content-type: application/problem+json\r\n")
+	assert.Contains(t, out, `"detail":"no such thing"`)
+
+	// Test: anything else is a 500 that doesn't leak the error
+	out = run(func(w *response.Writer, req *request.Request) error {
+		return fmt.Errorf("db password is hunter2")
+	})
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.NotContains(t, out, "hunter2")
+
+	// Test: an error after the status went out adds nothing to the response
+	out = run(func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*headers.NewHeaders())
+		w.WriteBody([]byte("half a respo"))
+		return &HandlerError{StatusCode: response.StatusNotFound, Message: "no such thing"}
+	})
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhalf a respo"))
+	assert.NotContains(t, out, "problem")
+}
+
+func TestHandleErrorsAbort(t *testing.T) {
+	server, err := Serve(0, HandleErrors(func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*headers.NewHeaders())
+		w.WriteBody([]byte("half a respo"))
+		return io.ErrUnexpectedEOF
+	}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// Test: on a connection the buffered response is dropped and the
+	// connection cut, so the client can't mistake it for a complete one
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errForbidden = fmt.Errorf("forbidden")
+
+type FileServerOptions struct {
+	// ListDirectories renders an HTML listing for directories without
+	// an index.html
+	ListDirectories bool
+	// FollowSymlinks serves symlinks as long as their target stays inside
+	// the root. Without it any symlink in the path is refused.
+	FollowSymlinks bool
+	// ServeDotfiles serves and lists names starting with a dot, such as
+	// .git or .env. Without it they look like they don't exist.
+	ServeDotfiles bool
+}
+
+// FileServer returns a Handler serving the directory tree at root
+func FileServer(root string, opts FileServerOptions) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		fileServerError(w, serveFile(w, req, root, opts))
+	}
+}
+
+func fileServerError(w *response.Writer, err error) {
+	if err == nil {
+		return
+	}
+	var he *HandlerError
+	switch {
+	case errors.As(err, &he):
+	case errors.Is(err, fs.ErrNotExist):
+		he = &HandlerError{StatusCode: response.StatusNotFound, Message: "file not found"}
+	case errors.Is(err, errForbidden), errors.Is(err, fs.ErrPermission):
+		he = &HandlerError{StatusCode: response.StatusForbidden, Message: "forbidden"}
+	default:
+		he = &HandlerError{StatusCode: response.StatusInternalServerError, Message: "internal server error"}
+	}
+	he.Write(w)
+}
+
+func serveFile(w *response.Writer, req *request.Request, root string, opts FileServerOptions) error {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		h := headers.NewHeaders()
+		h.Set("Allow", "GET, HEAD")
+		return &HandlerError{StatusCode: response.StatusMethodNotAllowed, Message: "method not allowed", Headers: h}
+	}
+
+	urlPath, err := cleanPath(req.Path())
+	if err != nil {
+		return &HandlerError{StatusCode: response.StatusBadRequest, Message: err.Error()}
+	}
+	if !opts.ServeDotfiles && hasDotfile(urlPath) {
+		return fs.ErrNotExist
+	}
+	name, err := resolvePath(root, urlPath, opts.FollowSymlinks)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		// relative links in the page only work with the trailing slash
+		if !strings.HasSuffix(urlPath, "/") {
+			_, rawQuery, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+			return redirect(w, (&url.URL{Path: urlPath + "/", RawQuery: rawQuery}).String())
+		}
+		index := filepath.Join(name, "index.html")
+		if indexInfo, err := os.Stat(index); err == nil && !indexInfo.IsDir() {
+			if _, err := resolvePath(root, urlPath+"index.html", opts.FollowSymlinks); err != nil {
+				return err
+			}
+			return sendFile(w, req, index, indexInfo)
+		}
+		if !opts.ListDirectories {
+			return errForbidden
+		}
+		return listDirectory(w, name, urlPath, info, opts.ServeDotfiles)
+	}
+	return sendFile(w, req, name, info)
+}
+
+// cleanPath decodes the request path and removes dot-segments, so the
+// result always starts with "/" and never walks above it
+func cleanPath(rawPath string) (string, error) {
+	p, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return "", fmt.Errorf("invalid path escape")
+	}
+	if strings.ContainsFunc(p, func(c rune) bool { return c < 0x20 || c == 0x7f || c == '\\' }) {
+		return "", fmt.Errorf("invalid character in path")
+	}
+
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// hasDotfile reports whether a segment of a clean url path is hidden
+func hasDotfile(urlPath string) bool {
+	for _, part := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath maps a clean url path onto the file system and applies the
+// symlink policy
+func resolvePath(root, urlPath string, followSymlinks bool) (string, error) {
+	name := filepath.Join(root, filepath.FromSlash(urlPath))
+
+	if followSymlinks {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return "", err
+		}
+		realName, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(realRoot, realName)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", errForbidden
+		}
+		return name, nil
+	}
+
+	current := filepath.Clean(root)
+	for _, part := range strings.Split(strings.Trim(urlPath, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", errForbidden
+		}
+	}
+	return name, nil
+}
+
+func redirect(w *response.Writer, location string) error {
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", location)
+	if err := w.WriteStatusLine(response.StatusMovedPermanently); err != nil {
+		return err
+	}
+	return w.WriteHeaders(*h)
+}
+
+func sendFile(w *response.Writer, req *request.Request, name string, info fs.FileInfo) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// same idea as nginx: the file changes when its mtime or size does
+	h := headers.NewHeaders()
+	h.Set("ETag", response.StrongETag(fmt.Sprintf("%x-%x", info.ModTime().Unix(), info.Size())))
+	return response.ServeContent(w, req, name, info.ModTime(), f, h)
+}
+
+func listDirectory(w *response.Writer, name, urlPath string, info fs.FileInfo, dotfiles bool) error {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var b strings.Builder
+	title := html.EscapeString(urlPath)
+	fmt.Fprintf(&b, "<html>\n  <head><title>Index of %s</title></head>\n  <body>\n    <h1>Index of %s</h1>\n    <ul>\n", title, title)
+	if urlPath != "/" {
+		b.WriteString("      <li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if !dotfiles && strings.HasPrefix(entryName, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		// "./" keeps names with a colon from being read as a scheme
+		fmt.Fprintf(&b, "      <li><a href=\"./%s\">%s</a></li>\n", href, html.EscapeString(entryName))
+	}
+	b.WriteString("    </ul>\n  </body>\n</html>\n")
+
+	h := response.GetDefaultHeaders(b.Len())
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Last-Modified", info.ModTime().UTC().Format(response.TimeFormat))
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+	_, err = w.WriteBody([]byte(b.String()))
+	return err
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runs h against a raw request and returns the raw response
+func serveRaw(t *testing.T, h Handler, rawRequest string) string {
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	w := response.NewBufferedWriter(&out, response.DefaultBufferSize)
+	h(w, req)
+	require.NoError(t, w.Finish())
+	return out.String()
+}
+
+func get(t *testing.T, h Handler, target string) string {
+	return serveRaw(t, h, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+}
+
+func TestFileServer(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "noext"), []byte("<html><body>hi</body></html>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "site"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "site", "index.html"), []byte("<h1>index</h1>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "files"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "files", "a <b>.txt"), []byte("a"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "files", ".env"), []byte("TOKEN=1"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, ".git"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".git", "config"), []byte("[core]"), 0o644))
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "hello.txt"), filepath.Join(root, "link.txt")))
+
+	fileServer := FileServer(root, FileServerOptions{})
+
+	// Test: plain file with MIME type and Last-Modified
+	out := get(t, fileServer, "/hello.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, out, "content-length: 5\r\n")
+	assert.Contains(t, out, "last-modified: ")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: sniffed content type
+	out = get(t, fileServer, "/noext")
+	assert.Contains(t, out, "content-type: text/html; charset=utf-8\r\n")
+
+	// Test: index.html and the trailing slash redirect
+	out = get(t, fileServer, "/site/")
+	assert.True(t, strings.HasSuffix(out, "<h1>index</h1>"))
+	out = get(t, fileServer, "/site")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, out, "location: /site/\r\n")
+
+	// Test: the redirect keeps the query and escapes the path
+	out = get(t, fileServer, "/site?lang=en&x=%2F")
+	assert.Contains(t, out, "location: /site/?lang=en&x=%2F\r\n")
+	out = get(t, fileServer, "/files")
+	assert.Contains(t, out, "location: /files/\r\n")
+	require.NoError(t, os.Mkdir(filepath.Join(root, "a b"), 0o755))
+	out = get(t, fileServer, "/a%20b")
+	assert.Contains(t, out, "location: /a%20b/\r\n")
+
+	// Test: control characters are refused
+	out = get(t, fileServer, "/hello.txt%0d%0aX:%20y")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	out = get(t, fileServer, "/hello%7f.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: dotfiles are hidden unless asked for
+	out = get(t, fileServer, "/files/.env")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = get(t, fileServer, "/.git/config")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = get(t, fileServer, "/%2egit/config")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = get(t, FileServer(root, FileServerOptions{ServeDotfiles: true}), "/.git/config")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n[core]"))
+
+	// Test: listings are off by default
+	out = get(t, fileServer, "/files/")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: traversal stays inside the root
+	out = get(t, fileServer, "/../../etc/passwd")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	out = get(t, fileServer, "/site/%2e%2e/%2e%2e/hello.txt")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: symlinks are refused unless allowed, and never leave the root
+	out = get(t, fileServer, "/link.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+	following := FileServer(root, FileServerOptions{FollowSymlinks: true, ListDirectories: true})
+	out = get(t, following, "/link.txt")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+	out = get(t, following, "/escape.txt")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: directory listing escapes names
+	out = get(t, following, "/files/")
+	assert.Contains(t, out, `<a href="./a%20%3Cb%3E.txt">a &lt;b&gt;.txt</a>`)
+	assert.NotContains(t, out, ".env")
+
+	// Test: other methods
+	out = serveRaw(t, fileServer, "DELETE /hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "allow: GET, HEAD\r\n")
+}
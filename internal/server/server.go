@@ -1,25 +1,62 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
+	// Headers are added to the error response (optional)
+	Headers *headers.Headers
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 type Server struct {
 	listener net.Listener
-	closed   bool
+	closed   atomic.Bool
 	handler  Handler
+	options  Options
+	certs    *certStore
+
+	// connections being served, hijacked ones are removed
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+type Options struct {
+	// ServerName is sent in the Server header, empty leaves it out
+	ServerName string
+	// TLS turns on HTTPS with the given certificates
+	TLS *TLSOptions
+	// DisableHTTP2 serves HTTP/1.1 only. Otherwise HTTP/2 is offered over
+	// TLS with ALPN and accepted in cleartext from clients that start
+	// with the HTTP/2 preface (prior knowledge) or ask for Upgrade: h2c.
+	DisableHTTP2 bool
+	// MaxConcurrentStreams per HTTP/2 connection, defaults to
+	// http2.DefaultMaxConcurrentStreams
+	MaxConcurrentStreams uint32
 }
 
+// how long a client gets to finish the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
 func Serve(port int, handler Handler) (*Server, error) {
+	return ServeWithOptions(port, handler, Options{})
+}
+
+func ServeWithOptions(port int, handler Handler, options Options) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
@@ -27,24 +64,72 @@ func Serve(port int, handler Handler) (*Server, error) {
 
 	server := &Server{
 		listener: listener,
-		closed:   false,
 		handler:  handler,
+		options:  options,
+		conns:    map[net.Conn]struct{}{},
+	}
+
+	if options.TLS != nil {
+		certs, err := newCertStore(options.TLS.Certificates)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		config, err := options.TLS.config(certs, !options.DisableHTTP2)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		interval := options.TLS.ReloadInterval
+		if interval == 0 {
+			interval = DefaultReloadInterval
+		}
+		go certs.watch(interval)
+		server.certs = certs
+		server.listener = tls.NewListener(listener, config)
 	}
 
 	go server.Listen()
 	return server, nil
 }
 
+// Addr is the address the server listens on, handy with port 0
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting and closes the connections still being served.
+// Hijacked connections belong to their handler and are left alone.
 func (s *Server) Close() error {
-	s.closed = true
-	return s.listener.Close()
+	s.closed.Store(true)
+	err := s.listener.Close()
+	if s.certs != nil {
+		s.certs.close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *Server) track(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
 }
 
 func (s *Server) Listen() {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			if s.closed {
+			if s.closed.Load() {
 				return
 			}
 			fmt.Println("accept error: ", err)
@@ -54,15 +139,122 @@ func (s *Server) Listen() {
 	}
 }
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	s.track(conn, true)
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			s.track(conn, false)
+			conn.Close()
+		}
+	}()
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Println("tls handshake error: ", err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	var reader io.Reader = conn
+	if !s.options.DisableHTTP2 {
+		if tlsState != nil {
+			if tlsState.NegotiatedProtocol == "h2" {
+				s.serveHTTP2(conn, http2.Options{TLS: tlsState})
+				return
+			}
+		} else {
+			sniffed, isHTTP2, err := http2.SniffPreface(conn)
+			if isHTTP2 {
+				s.serveHTTP2(&sniffedConn{conn, io.MultiReader(bytes.NewReader(sniffed), conn)}, http2.Options{})
+				return
+			}
+			if err != nil && len(sniffed) == 0 {
+				return
+			}
+			reader = io.MultiReader(bytes.NewReader(sniffed), conn)
+		}
+	}
 
-	responseWriter := response.NewWriter(conn)
+	responseWriter := response.NewBufferedWriter(conn, response.DefaultBufferSize)
+	responseWriter.SetServerName(s.options.ServerName)
 	headers := response.GetDefaultHeaders(0)
-	r, err := request.RequestFromReader(conn)
+	r, err := request.RequestFromReader(reader)
 	if err != nil {
 		responseWriter.WriteStatusLine(response.StatusBadRequest)
 		responseWriter.WriteHeaders(*headers)
+		responseWriter.Finish()
 		return
 	}
+	r.TLS = tlsState
+	r.RemoteAddr = conn.RemoteAddr().String()
+
+	// a cleartext client may switch to HTTP/2 with its first request
+	if !s.options.DisableHTTP2 && tlsState == nil {
+		if settings, ok := r.H2CUpgrade(); ok {
+			s.upgradeH2C(conn, responseWriter, r, settings)
+			return
+		}
+	}
+
+	responseWriter.SetHijacker(func() (net.Conn, []byte, error) {
+		s.track(conn, false)
+		hijacked = true
+		return conn, r.Unread(), nil
+	})
+
+	// HEAD is served by the GET code path, the writer drops the body
+	if r.HeadAsGet() {
+		responseWriter.DiscardBody()
+	}
 	s.handler(responseWriter, r)
+
+	// sends whatever the handler left buffered and ends chunked bodies
+	if err := responseWriter.Finish(); err != nil {
+		fmt.Println("response error: ", err)
+	}
+}
+
+// sniffedConn replays the bytes read while looking for the HTTP/2 preface
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// upgradeH2C answers an Upgrade: h2c request with 101 Switching Protocols
+// and serves the rest of the connection as HTTP/2, the request itself on
+// stream 1
+func (s *Server) upgradeH2C(conn net.Conn, w *response.Writer, r *request.Request, settings []byte) {
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	w.WriteStatusLine(response.StatusSwitchingProtocols)
+	w.WriteHeaders(*h)
+	if err := w.Flush(); err != nil {
+		fmt.Println("response error: ", err)
+		return
+	}
+	// the client preface may already sit behind the request
+	s.serveHTTP2(&sniffedConn{conn, io.MultiReader(bytes.NewReader(r.Unread()), conn)}, http2.Options{
+		Upgrade:         r,
+		UpgradeSettings: settings,
+	})
+}
+
+// serveHTTP2 fills in the server wide options and serves conn as HTTP/2
+func (s *Server) serveHTTP2(conn net.Conn, opts http2.Options) {
+	opts.ServerName = s.options.ServerName
+	opts.MaxConcurrentStreams = s.options.MaxConcurrentStreams
+	err := http2.ServeConn(conn, http2.Handler(s.handler), opts)
+	if err != nil {
+		fmt.Println("http2 error: ", err)
+	}
 }
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	writerErrs := make(chan error, 1)
+	server, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Upgrade", "echo")
+		h.Set("Connection", "Upgrade")
+		w.WriteStatusLine(response.StatusSwitchingProtocols)
+		w.WriteHeaders(*h)
+
+		conn, unread, err := w.Hijack()
+		if err != nil {
+			writerErrs <- err
+			return
+		}
+		_, err = w.WriteBody([]byte("too late"))
+		writerErrs <- err
+
+		// echo what the client sent behind the request, then the rest
+		go func() {
+			defer conn.Close()
+			conn.Write(unread)
+			io.Copy(conn, conn)
+		}()
+	})
+	require.NoError(t, err)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: bytes pipelined right after the request reach the handler
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nearly "))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.NotContains(t, line, "content-length")
+		assert.NotContains(t, line, "transfer-encoding")
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	// Test: the writer refuses to touch the connection once hijacked
+	require.ErrorIs(t, <-writerErrs, response.ERROR_HIJACKED)
+
+	// Test: the raw connection is the handler's now
+	_, err = conn.Write([]byte("late"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("early late"))
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(echoed))
+
+	// Test: closing the server leaves hijacked connections alone
+	require.NoError(t, server.Close())
+	_, err = conn.Write([]byte("!"))
+	require.NoError(t, err)
+	b, err := br.ReadByte()
+	require.NoError(t, err)
+	assert.Equal(t, byte('!'), b)
+}
+
+func TestHTTP2(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		body := "HTTP/" + req.RequestLine.HttpVersion + " " + req.RequestLine.Method + " " + string(req.Body)
+		if req.TLS != nil {
+			body += " " + req.TLS.NegotiatedProtocol
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+	check := func(t *testing.T, client *http.Client, url, want string) {
+		// several requests at once share the one connection
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := client.Post(url, "text/plain", strings.NewReader("hi"))
+				require.NoError(t, err)
+				defer res.Body.Close()
+				body, err := io.ReadAll(res.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "HTTP/2.0", res.Proto)
+				assert.Equal(t, "httpfromtcp", res.Header.Get("Server"))
+				assert.Equal(t, want, string(body))
+			}()
+		}
+		wg.Wait()
+	}
+
+	// Test: h2 over TLS through ALPN
+	cert := writeCert(t, t.TempDir(), "server", "server", "localhost")
+	s, err := ServeWithOptions(0, handler, Options{ServerName: "httpfromtcp", TLS: &TLSOptions{Certificates: []CertificateFiles{cert}}})
+	require.NoError(t, err)
+	defer s.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	check(t, client, "https://"+s.Addr().String()+"/", "HTTP/2 POST hi h2")
+
+	// Test: cleartext with prior knowledge, HTTP/1.1 still works next to it
+	s, err = ServeWithOptions(0, handler, Options{ServerName: "httpfromtcp"})
+	require.NoError(t, err)
+	defer s.Close()
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	check(t, &http.Client{Transport: &http.Transport{Protocols: protocols}}, "http://"+s.Addr().String()+"/", "HTTP/2 POST hi")
+
+	res, err := http.Get("http://" + s.Addr().String() + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "HTTP/1.1 GET ", string(body))
+
+	// Test: h2c upgrade, the preface right behind the request
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	upgrade := "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n" +
+		"Upgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\nhi"
+	_, err = io.WriteString(conn, upgrade+http2.ClientPreface+"\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	res, err = http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "h2c", res.Header.Get("Upgrade"))
+
+	// Test: the request is answered on stream 1
+	decoder := hpack.NewDecoder(hpack.DefaultTableSize)
+	var fields []hpack.HeaderField
+	body = nil
+	for {
+		head := make([]byte, 9)
+		_, err := io.ReadFull(br, head)
+		require.NoError(t, err)
+		payload := make([]byte, int(head[0])<<16|int(head[1])<<8|int(head[2]))
+		_, err = io.ReadFull(br, payload)
+		require.NoError(t, err)
+		if binary.BigEndian.Uint32(head[5:]) != 1 {
+			continue
+		}
+		switch head[3] {
+		case 0x1: // HEADERS
+			fields, err = decoder.Decode(payload)
+			require.NoError(t, err)
+		case 0x0: // DATA
+			body = append(body, payload...)
+		}
+		if head[4]&0x1 != 0 {
+			break
+		}
+	}
+	assert.Contains(t, fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	assert.Equal(t, "HTTP/2 POST hi", string(body))
+}
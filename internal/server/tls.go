@@ -0,0 +1,267 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ERROR_NO_CERTIFICATES = fmt.Errorf("tls: no certificates configured")
+var ERROR_NO_CLIENT_CAS = fmt.Errorf("tls: client auth needs ClientCAs or ClientCAFile")
+
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLSOptions struct {
+	// Certificates are picked by SNI, the first one is served to clients
+	// that send no or an unknown server name
+	Certificates []CertificateFiles
+	// ReloadInterval is how often the files are checked for changes,
+	// 0 means DefaultReloadInterval and a negative value turns polling
+	// off. SIGHUP always reloads.
+	ReloadInterval time.Duration
+	// MinVersion defaults to TLS 1.2
+	MinVersion uint16
+
+	// ClientAuth asks clients for a certificate, see ClientAuthMode
+	ClientAuth ClientAuthMode
+	// ClientCAs verifies client certificates. ClientCAFile, a PEM
+	// bundle, is loaded into it at startup.
+	ClientCAs    *x509.CertPool
+	ClientCAFile string
+}
+
+type ClientAuthMode int
+
+const (
+	// ClientAuthNone doesn't ask for a client certificate
+	ClientAuthNone ClientAuthMode = iota
+	// ClientAuthOptional verifies a certificate if the client sends one
+	ClientAuthOptional
+	// ClientAuthRequired fails the handshake without a valid certificate
+	ClientAuthRequired
+)
+
+const DefaultReloadInterval = 30 * time.Second
+
+// certStore holds the loaded certificates. A reload swaps them for new
+// handshakes, connections already established keep theirs.
+type certStore struct {
+	files []CertificateFiles
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modtimes []time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newCertStore(files []CertificateFiles) (*certStore, error) {
+	if len(files) == 0 {
+		return nil, ERROR_NO_CERTIFICATES
+	}
+	store := &certStore{files: files, stop: make(chan struct{})}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads every pair from disk. On error the old certificates stay in
+// place, a half written file must not take the server down.
+func (s *certStore) load() error {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	byName := map[string]*tls.Certificate{}
+	modtimes := make([]time.Time, 0, len(s.files))
+
+	for _, f := range s.files {
+		modtime, err := filesModTime(f)
+		if err != nil {
+			return err
+		}
+		modtimes = append(modtimes, modtime)
+	}
+	// a broken file is only retried once it changes again
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.modtimes = modtimes
+	}()
+
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: loading %s: %w", f.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("tls: parsing %s: %w", f.CertFile, err)
+			}
+		}
+
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// the first certificate listed wins a shared name
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = certs
+	s.byName = byName
+	return nil
+}
+
+// filesModTime is the newer of the cert and key modification times
+func filesModTime(f CertificateFiles) (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{f.CertFile, f.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// changed reports whether any file was modified since the last load
+func (s *certStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, f := range s.files {
+		modtime, err := filesModTime(f)
+		if err != nil {
+			// probably being replaced, try again on the next tick
+			continue
+		}
+		if !modtime.Equal(s.modtimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertificate does the SNI lookup: exact name, then a wildcard for the
+// first label, then the default certificate
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := s.byName[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := s.byName["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// watch reloads on SIGHUP and when the files change on disk
+func (s *certStore) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-hup:
+		case <-tick:
+			if !s.changed() {
+				continue
+			}
+		}
+		if err := s.load(); err != nil {
+			fmt.Println("certificate reload error: ", err)
+		}
+	}
+}
+
+// close stops the reloads, the server may call it more than once
+func (s *certStore) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls: no certificates in %s", name)
+	}
+	return pool, nil
+}
+
+func (opts *TLSOptions) config(store *certStore, http2 bool) (*tls.Config, error) {
+	minVersion := opts.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	config := &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     minVersion,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if opts.ClientAuth == ClientAuthNone {
+		return config, nil
+	}
+
+	config.ClientCAs = opts.ClientCAs
+	if opts.ClientCAFile != "" {
+		pool, err := LoadCertPool(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+	}
+	// without a pool Go would check against the system roots, anyone
+	// with a public certificate would get in
+	if config.ClientCAs == nil {
+		return nil, ERROR_NO_CLIENT_CAS
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if opts.ClientAuth == ClientAuthRequired {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
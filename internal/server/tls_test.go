@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a self-signed certificate for names into dir and
+// returns the file pair
+func writeCert(t *testing.T, dir, prefix, commonName string, names ...string) CertificateFiles {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertificateFiles{
+		CertFile: filepath.Join(dir, prefix+".crt"),
+		KeyFile:  filepath.Join(dir, prefix+".key"),
+	}
+	// write to a temp name and rename, the way certbot and friends do
+	for name, block := range map[string]*pem.Block{
+		files.CertFile: {Type: "CERTIFICATE", Bytes: der},
+		files.KeyFile:  {Type: "PRIVATE KEY", Bytes: keyDER},
+	} {
+		require.NoError(t, os.WriteFile(name+".tmp", pem.EncodeToMemory(block), 0o600))
+		require.NoError(t, os.Rename(name+".tmp", name))
+	}
+	return files
+}
+
+// tlsGet sends a request with the given SNI and returns the common name of
+// the certificate the server presented plus the response
+func tlsGet(t *testing.T, addr, serverName string) (string, string) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(bufio.NewReader(conn))
+	require.NoError(t, err)
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, string(out)
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert := writeCert(t, dir, "default", "default", "localhost")
+	siteCert := writeCert(t, dir, "site", "site", "site.test", "*.apps.test")
+
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		body := "plain"
+		if req.TLS != nil {
+			body = tls.VersionName(req.TLS.Version) + " " + req.TLS.ServerName
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}, Options{TLS: &TLSOptions{
+		Certificates:   []CertificateFiles{defaultCert, siteCert},
+		ReloadInterval: 10 * time.Millisecond,
+	}})
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	// Test: the handler sees the negotiated state
+	name, out := tlsGet(t, addr, "site.test")
+	assert.Equal(t, "site", name)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nTLS 1.3 site.test"))
+
+	// Test: SNI picks by exact name, wildcard, or falls back to the first
+	name, _ = tlsGet(t, addr, "API.apps.test")
+	assert.Equal(t, "site", name)
+	name, _ = tlsGet(t, addr, "deep.api.apps.test")
+	assert.Equal(t, "default", name)
+	name, _ = tlsGet(t, addr, "")
+	assert.Equal(t, "default", name)
+
+	// Test: an open connection survives a reload and new ones get the new certificate
+	open, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "site.test", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer open.Close()
+	writeCert(t, dir, "site", "site v2", "site.test")
+	require.Eventually(t, func() bool {
+		name, _ := tlsGet(t, addr, "site.test")
+		return name == "site v2"
+	}, 5*time.Second, 20*time.Millisecond)
+	_, err = open.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	statusLine, err := bufio.NewReader(open).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+
+	// Test: a broken file keeps the old certificate
+	require.NoError(t, os.WriteFile(siteCert.CertFile, []byte("garbage"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	name, _ = tlsGet(t, addr, "site.test")
+	assert.Equal(t, "site v2", name)
+
+	// Test: startup fails without usable certificates
+	_, err = ServeWithOptions(0, nil, Options{TLS: &TLSOptions{}})
+	require.ErrorIs(t, err, ERROR_NO_CERTIFICATES)
+	_, err = ServeWithOptions(0, nil, Options{TLS: &TLSOptions{Certificates: []CertificateFiles{siteCert}}})
+	require.Error(t, err)
+
+	// Test: the server can be closed more than once
+	assert.NotPanics(t, func() {
+		s.Close()
+		s.Close()
+	})
+}
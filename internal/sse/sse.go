@@ -0,0 +1,178 @@
+package sse
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ERROR_CLIENT_GONE = fmt.Errorf("sse client disconnected")
+
+// Event is a single server-sent event. Empty fields are left out.
+type Event struct {
+	ID    string
+	Event string
+	// Data may span several lines, each one becomes its own data: field
+	Data string
+	// Retry tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+// Stream writes a text/event-stream response. Its methods can be called
+// from several goroutines, e.g. a producer and the heartbeat.
+type Stream struct {
+	mu          sync.Mutex
+	w           *response.Writer
+	lastEventID string
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewStream sends the event-stream headers and flushes them, so the client
+// sees the connection open before the first event
+func NewStream(w *response.Writer, req *request.Request) (*Stream, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "close")
+	// tells buffering proxies like nginx to pass events through right away
+	h.Set("X-Accel-Buffering", "no")
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := req.Headers.Get("last-event-id")
+	s := &Stream{
+		w:           w,
+		lastEventID: lastEventID,
+		done:        make(chan struct{}),
+	}
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LastEventID is the id the client saw last before reconnecting, so the
+// handler can resume from there. Empty on a first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once a write fails because the client went away
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Stream) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// flush expects s.mu to be held (or the stream not shared yet)
+func (s *Stream) flush() error {
+	if err := s.w.Flush(); err != nil {
+		s.closeOnce.Do(func() { close(s.done) })
+		return fmt.Errorf("%w: %v", ERROR_CLIENT_GONE, err)
+	}
+	return nil
+}
+
+func (s *Stream) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed() {
+		return ERROR_CLIENT_GONE
+	}
+	if _, err := s.w.Write(b); err != nil {
+		s.closeOnce.Do(func() { close(s.done) })
+		return fmt.Errorf("%w: %v", ERROR_CLIENT_GONE, err)
+	}
+	return s.flush()
+}
+
+// Format serializes an event in the text/event-stream format
+func Format(ev Event) ([]byte, error) {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return nil, fmt.Errorf("event id must be a single line without NUL")
+	}
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return nil, fmt.Errorf("event name must be a single line")
+	}
+
+	var b strings.Builder
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", ev.ID)
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+
+	for _, line := range splitLines(ev.Data) {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return []byte(b.String()), nil
+}
+
+// splitLines splits at any of \r\n, \n and \r, they all end a line for
+// the client
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
+
+// Send writes one event and flushes it to the client
+func (s *Stream) Send(ev Event) error {
+	b, err := Format(ev)
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+// Comment writes a comment line, which clients ignore
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		fmt.Fprintf(&b, ": %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write([]byte(b.String()))
+}
+
+// Heartbeat sends a comment every interval until the client goes away or
+// stop is closed. Writing is the only way to notice a dead connection, so
+// this is what makes Done fire for idle streams.
+func (s *Stream) Heartbeat(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Comment("heartbeat"); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package sse
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	b, err := Format(Event{ID: "7", Event: "update", Data: "line one\nline two", Retry: 3 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "id: 7\nevent: update\nretry: 3000\ndata: line one\ndata: line two\n\n", string(b))
+
+	// Test: \r\n and \r both split data lines
+	b, err = Format(Event{Data: "a\r\nb\rc"})
+	require.NoError(t, err)
+	assert.Equal(t, "data: a\ndata: b\ndata: c\n\n", string(b))
+
+	// Test: ids can't smuggle in extra fields
+	_, err = Format(Event{ID: "1\ndata: injected"})
+	require.Error(t, err)
+}
+
+func newRequest(t *testing.T, fields string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\n" + fields + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestStream(t *testing.T) {
+	var out bytes.Buffer
+	w := response.NewBufferedWriter(&out, response.DefaultBufferSize)
+	s, err := NewStream(w, newRequest(t, "Last-Event-ID: 41\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "41", s.LastEventID())
+
+	// Test: headers are flushed before any event
+	assert.Contains(t, out.String(), "content-type: text/event-stream\r\n")
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+
+	// Test: each event is flushed as it is sent
+	require.NoError(t, s.Send(Event{ID: "42", Data: "hello"}))
+	assert.True(t, strings.HasSuffix(out.String(), "id: 42\ndata: hello\n\n\r\n"))
+	require.NoError(t, s.Comment("ping"))
+	assert.True(t, strings.HasSuffix(out.String(), ": ping\n\n\r\n"))
+
+	// Test: a lone CR in a comment can't start a field line
+	require.NoError(t, s.Comment("a\rdata: injected\r\nb"))
+	assert.True(t, strings.HasSuffix(out.String(), ": a\n: data: injected\n: b\n\n\r\n"))
+}
+
+type brokenConn struct {
+	failAfter int
+	writes    int
+}
+
+func (b *brokenConn) Write(p []byte) (int, error) {
+	b.writes++
+	if b.writes > b.failAfter {
+		return 0, fmt.Errorf("connection reset by peer")
+	}
+	return len(p), nil
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	conn := &brokenConn{failAfter: 1}
+	w := response.NewBufferedWriter(conn, response.DefaultBufferSize)
+	s, err := NewStream(w, newRequest(t, ""))
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Heartbeat(time.Millisecond, stop)
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat did not notice the disconnect")
+	}
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ERROR_CLIENT_GONE)
+}
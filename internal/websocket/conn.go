@@ -0,0 +1,399 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	opContinuation = 0x0
+	TextMessage    = MessageType(0x1)
+	BinaryMessage  = MessageType(0x2)
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// close codes from RFC 6455 7.4.1
+const (
+	CloseNormal           = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatus         = 1005
+	CloseAbnormal         = 1006
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseMandatoryExt     = 1010
+	CloseInternalError    = 1011
+	maxControlPayloadSize = 125
+)
+
+// CloseError is returned by ReadMessage once the connection is closed,
+// either by the peer or because it broke the protocol
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Text)
+}
+
+type Options struct {
+	// Subprotocols the server supports, in order of preference
+	Subprotocols []string
+	// MaxMessageSize caps a whole (reassembled) message, bigger ones
+	// close the connection with 1009
+	MaxMessageSize int64
+}
+
+const DefaultMaxMessageSize = 16 << 20
+
+// how long Close waits for the peer to answer the close frame
+const closeTimeout = 5 * time.Second
+
+type Conn struct {
+	rwc      io.ReadWriteCloser
+	br       *bufio.Reader
+	isServer bool
+	maxSize  int64
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// NewConn speaks websocket over rwc. Servers expect masked frames from the
+// client and send unmasked ones, clients the other way around.
+func NewConn(rwc io.ReadWriteCloser, isServer bool, opts Options) *Conn {
+	return newConn(rwc, bufio.NewReader(rwc), isServer, opts)
+}
+
+func newConn(rwc io.ReadWriteCloser, br *bufio.Reader, isServer bool, opts Options) *Conn {
+	maxSize := opts.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &Conn{rwc: rwc, br: br, isServer: isServer, maxSize: maxSize}
+}
+
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// readFrame reads and unmasks a single frame, checking the framing rules
+// of RFC 6455 5.2
+func (c *Conn) readFrame() (frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return frame{}, err
+	}
+
+	f := frame{
+		fin:    head[0]&0x80 != 0,
+		opcode: head[0] & 0x0F,
+	}
+	if head[0]&0x70 != 0 {
+		return f, &CloseError{CloseProtocolError, "reserved bits set without an extension"}
+	}
+	switch f.opcode {
+	case opContinuation, byte(TextMessage), byte(BinaryMessage), opClose, opPing, opPong:
+	default:
+		return f, &CloseError{CloseProtocolError, "unknown opcode"}
+	}
+
+	masked := head[1]&0x80 != 0
+	if masked != c.isServer {
+		return f, &CloseError{CloseProtocolError, "wrong masking for this side"}
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, &CloseError{CloseProtocolError, "invalid payload length"}
+		}
+	}
+
+	if isControl(f.opcode) && (!f.fin || length > maxControlPayloadSize) {
+		return f, &CloseError{CloseProtocolError, "invalid control frame"}
+	}
+	// check before allocating, the length comes from the peer
+	if length > uint64(c.maxSize) {
+		return f, &CloseError{CloseMessageTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return f, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return f, err
+	}
+	if masked {
+		maskBytes(mask, f.payload)
+	}
+	return f, nil
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// writeFrame expects c.writeMu to be held
+func (c *Conn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	b := make([]byte, 0, 14+len(payload))
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	b = append(b, first)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		b = append(b, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+
+	if c.isServer {
+		b = append(b, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		b = append(b, mask[:]...)
+		start := len(b)
+		b = append(b, payload...)
+		maskBytes(mask, b[start:])
+	}
+	_, err := c.rwc.Write(b)
+	return err
+}
+
+func (c *Conn) write(fin bool, opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return fmt.Errorf("websocket: write after close")
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return c.writeFrame(fin, opcode, payload)
+}
+
+// WriteMessage sends data as a single frame
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	return c.write(true, byte(messageType), data)
+}
+
+// WriteFragmented sends one message split over several frames. Control
+// frames from other goroutines may be interleaved between the fragments.
+func (c *Conn) WriteFragmented(messageType MessageType, fragments ...[]byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	if len(fragments) == 0 {
+		return c.WriteMessage(messageType, nil)
+	}
+	for i, fragment := range fragments {
+		opcode := byte(opContinuation)
+		if i == 0 {
+			opcode = byte(messageType)
+		}
+		if err := c.write(i == len(fragments)-1, opcode, fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping sends a ping, the peer answers with a pong
+func (c *Conn) Ping(payload []byte) error {
+	if len(payload) > maxControlPayloadSize {
+		return fmt.Errorf("websocket: control payload over %d bytes", maxControlPayloadSize)
+	}
+	return c.write(true, opPing, payload)
+}
+
+func closePayload(code int, reason string) []byte {
+	if code == CloseNoStatus {
+		return nil
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	b = append(b, reason...)
+	if len(b) > maxControlPayloadSize {
+		b = b[:maxControlPayloadSize]
+	}
+	return b
+}
+
+// validCloseCode reports whether a peer may send code, RFC 6455 7.4
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code < 1000 || code > 1014:
+		return false
+	}
+	switch code {
+	case 1004, CloseNoStatus, CloseAbnormal, 1015:
+		return false
+	}
+	return true
+}
+
+// fail sends a close frame for a protocol violation and drops the
+// connection without waiting for the peer
+func (c *Conn) fail(ce *CloseError) error {
+	c.write(true, opClose, closePayload(ce.Code, ce.Text))
+	c.rwc.Close()
+	return ce
+}
+
+// ReadMessage returns the next text or binary message. Fragments are put
+// back together, pings are answered and the close handshake is completed
+// on the way. It returns a *CloseError when the connection is closed.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var messageType MessageType
+	var message []byte
+	fragmented := false
+
+	for {
+		f, err := c.readFrame()
+		if ce, ok := err.(*CloseError); ok {
+			return 0, nil, c.fail(ce)
+		}
+		if err != nil {
+			c.rwc.Close()
+			return 0, nil, &CloseError{CloseAbnormal, err.Error()}
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.write(true, opPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opContinuation:
+			if !fragmented {
+				return 0, nil, c.fail(&CloseError{CloseProtocolError, "continuation without a message"})
+			}
+		default:
+			if fragmented {
+				return 0, nil, c.fail(&CloseError{CloseProtocolError, "new message inside a fragmented one"})
+			}
+			messageType = MessageType(f.opcode)
+			fragmented = true
+		}
+
+		if int64(len(message))+int64(len(f.payload)) > c.maxSize {
+			return 0, nil, c.fail(&CloseError{CloseMessageTooBig, "message too big"})
+		}
+		message = append(message, f.payload...)
+
+		if f.fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(&CloseError{CloseInvalidPayload, "text message is not valid utf-8"})
+			}
+			if message == nil {
+				message = []byte{}
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// handleClose answers a close frame from the peer with the same code and
+// closes the connection
+func (c *Conn) handleClose(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(&CloseError{CloseProtocolError, "invalid close payload"})
+	case len(payload) >= 2:
+		ce.Code = int(binary.BigEndian.Uint16(payload))
+		ce.Text = string(payload[2:])
+		if !validCloseCode(ce.Code) {
+			return c.fail(&CloseError{CloseProtocolError, "invalid close code"})
+		}
+		if !utf8.ValidString(ce.Text) {
+			return c.fail(&CloseError{CloseInvalidPayload, "close reason is not valid utf-8"})
+		}
+	}
+
+	c.write(true, opClose, closePayload(ce.Code, ""))
+	c.rwc.Close()
+	return ce
+}
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Close starts the close handshake with code and waits a bit for the
+// peer's close frame before dropping the connection
+func (c *Conn) Close(code int, reason string) error {
+	if err := c.write(true, opClose, closePayload(code, reason)); err != nil {
+		c.rwc.Close()
+		return err
+	}
+	if d, ok := c.rwc.(deadliner); ok {
+		d.SetReadDeadline(time.Now().Add(closeTimeout))
+	}
+	for {
+		f, err := c.readFrame()
+		if err != nil || f.opcode == opClose {
+			break
+		}
+	}
+	return c.rwc.Close()
+}
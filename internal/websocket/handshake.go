@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"strings"
+)
+
+var ERROR_BAD_HANDSHAKE = fmt.Errorf("bad websocket handshake")
+
+// RFC 6455 1.3, mixed into Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// AcceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgradeRequest reports whether req asks to switch to websocket
+func IsUpgradeRequest(req *request.Request) bool {
+	return req.Headers.HasToken("connection", "upgrade") && req.Headers.HasToken("upgrade", "websocket")
+}
+
+// checkHandshake validates the opening handshake (RFC 6455 4.2.1) and
+// returns the client's key
+func checkHandshake(req *request.Request) (string, error) {
+	if req.RequestLine.Method != "GET" {
+		return "", fmt.Errorf("%w: method must be GET", ERROR_BAD_HANDSHAKE)
+	}
+	if !IsUpgradeRequest(req) {
+		return "", fmt.Errorf("%w: missing Upgrade: websocket", ERROR_BAD_HANDSHAKE)
+	}
+	if host, _ := req.Headers.Get("host"); strings.TrimSpace(host) == "" {
+		return "", fmt.Errorf("%w: missing Host", ERROR_BAD_HANDSHAKE)
+	}
+	key, _ := req.Headers.Get("sec-websocket-key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return "", fmt.Errorf("%w: invalid Sec-WebSocket-Key", ERROR_BAD_HANDSHAKE)
+	}
+	return key, nil
+}
+
+// pickSubprotocol returns the first of the client's subprotocols that the
+// server supports
+func pickSubprotocol(req *request.Request, supported []string) string {
+	value, _ := req.Headers.Get("sec-websocket-protocol")
+	for _, offered := range strings.Split(value, ",") {
+		offered = strings.TrimSpace(offered)
+		for _, s := range supported {
+			if offered == s {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// Accept answers the opening handshake with 101 Switching Protocols.
+// A bad handshake gets a 400, a wrong version a 426 listing version 13.
+// It returns the negotiated subprotocol. After Accept the connection
+// speaks websocket, see NewConn.
+func Accept(w *response.Writer, req *request.Request, opts Options) (string, error) {
+	key, err := checkHandshake(req)
+	if err != nil {
+		w.WriteProblem(response.Problem{Status: response.StatusBadRequest, Detail: err.Error()})
+		return "", err
+	}
+	if version, _ := req.Headers.Get("sec-websocket-version"); version != "13" {
+		h := headers.NewHeaders()
+		h.Set("Sec-WebSocket-Version", "13")
+		w.WriteProblemWithHeaders(response.Problem{Status: response.StatusUpgradeRequired, Detail: "unsupported websocket version"}, h)
+		return "", fmt.Errorf("%w: unsupported version %q", ERROR_BAD_HANDSHAKE, version)
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+	subprotocol := pickSubprotocol(req, opts.Subprotocols)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return "", err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return "", err
+	}
+	return subprotocol, w.Flush()
+}
+
+// Upgrade accepts the handshake and takes the connection over from the
+// server. The returned Conn owns the connection.
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	if _, err := Accept(w, req, opts); err != nil {
+		return nil, err
+	}
+	conn, unread, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// frames the client sent right behind the handshake were already read
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(unread), conn))
+	return newConn(conn, br, true, opts), nil
+}
@@ -0,0 +1,246 @@
+package websocket
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccept(t *testing.T) {
+	// Test: the sample handshake from RFC 6455 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+
+	handshake := "GET /chat HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Protocol: chat, superchat\r\n"
+
+	req, err := request.RequestFromReader(strings.NewReader(handshake + "Sec-WebSocket-Version: 13\r\n\r\n"))
+	require.NoError(t, err)
+	var out bytes.Buffer
+	w := response.NewBufferedWriter(&out, response.DefaultBufferSize)
+	subprotocol, err := Accept(w, req, Options{Subprotocols: []string{"superchat"}})
+	require.NoError(t, err)
+	assert.Equal(t, "superchat", subprotocol)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, out.String(), "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, out.String(), "sec-websocket-protocol: superchat\r\n")
+	assert.NotContains(t, out.String(), "content-length")
+
+	// Test: wrong version
+	req, err = request.RequestFromReader(strings.NewReader(handshake + "Sec-WebSocket-Version: 8\r\n\r\n"))
+	require.NoError(t, err)
+	out.Reset()
+	w = response.NewBufferedWriter(&out, response.DefaultBufferSize)
+	_, err = Accept(w, req, Options{})
+	require.ErrorIs(t, err, ERROR_BAD_HANDSHAKE)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 426 Upgrade Required\r\n"))
+	assert.Contains(t, out.String(), "sec-websocket-version: 13\r\n")
+
+	// Test: not an upgrade at all
+	req, err = request.RequestFromReader(strings.NewReader("GET /chat HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	out.Reset()
+	w = response.NewBufferedWriter(&out, response.DefaultBufferSize)
+	_, err = Accept(w, req, Options{})
+	require.ErrorIs(t, err, ERROR_BAD_HANDSHAKE)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: no Host
+	noHost := strings.Replace(handshake, "Host: localhost:42069\r\n", "", 1)
+	req, err = request.RequestFromReader(strings.NewReader(noHost + "Sec-WebSocket-Version: 13\r\n\r\n"))
+	require.NoError(t, err)
+	out.Reset()
+	w = response.NewBufferedWriter(&out, response.DefaultBufferSize)
+	_, err = Accept(w, req, Options{})
+	require.ErrorIs(t, err, ERROR_BAD_HANDSHAKE)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 400 Bad Request\r\n"))
+}
+
+// echo runs a server side connection that sends every message back
+func echo(t *testing.T, opts Options) (*Conn, chan error) {
+	serverEnd, clientEnd := net.Pipe()
+	server := NewConn(serverEnd, true, opts)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			messageType, data, err := server.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := server.WriteMessage(messageType, data); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	return NewConn(clientEnd, false, Options{}), done
+}
+
+// rawFrame builds a masked client frame by hand, like the Autobahn fuzzing client
+func rawFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	b := []byte{first, 0x80 | byte(len(payload))}
+	b = append(b, mask[:]...)
+	masked := append([]byte{}, payload...)
+	maskBytes(mask, masked)
+	return append(b, masked...)
+}
+
+func expectClose(t *testing.T, client *Conn, code int) {
+	f, err := client.readFrame()
+	require.NoError(t, err)
+	require.Equal(t, byte(opClose), f.opcode)
+	require.GreaterOrEqual(t, len(f.payload), 2)
+	assert.Equal(t, code, int(f.payload[0])<<8|int(f.payload[1]))
+}
+
+func TestEcho(t *testing.T) {
+	client, done := echo(t, Options{})
+
+	// Test: text and binary messages, including empty and 16-bit lengths
+	for _, m := range []struct {
+		messageType MessageType
+		data        []byte
+	}{
+		{TextMessage, []byte("hello")},
+		{BinaryMessage, []byte{0, 1, 2, 255}},
+		{TextMessage, []byte{}},
+		{BinaryMessage, bytes.Repeat([]byte("x"), 70000)},
+	} {
+		go client.WriteMessage(m.messageType, m.data)
+		messageType, data, err := client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, m.messageType, messageType)
+		assert.Equal(t, m.data, data)
+	}
+
+	// Test: fragmented message with a ping in the middle
+	go func() {
+		client.write(false, byte(TextMessage), []byte("frag"))
+		client.write(true, opPing, []byte("are you there"))
+		client.write(false, opContinuation, []byte("ment"))
+		client.write(true, opContinuation, []byte("ed"))
+	}()
+	f, err := client.readFrame()
+	require.NoError(t, err)
+	assert.Equal(t, byte(opPong), f.opcode)
+	assert.Equal(t, "are you there", string(f.payload))
+	messageType, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "fragmented", string(data))
+
+	// Test: close handshake echoes the code
+	go client.write(true, opClose, closePayload(CloseGoingAway, "bye"))
+	expectClose(t, client, CloseGoingAway)
+	err = <-done
+	var ce *CloseError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, CloseGoingAway, ce.Code)
+	assert.Equal(t, "bye", ce.Text)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		frame []byte
+		code  int
+	}{
+		{"unmasked client frame", []byte{0x81, 0x02, 'h', 'i'}, CloseProtocolError},
+		{"reserved bits", append([]byte{0xC1}, rawFrame(true, 1, []byte("hi"))[1:]...), CloseProtocolError},
+		{"unknown opcode", rawFrame(true, 0x3, nil), CloseProtocolError},
+		{"fragmented ping", rawFrame(false, opPing, nil), CloseProtocolError},
+		{"continuation first", rawFrame(true, opContinuation, []byte("x")), CloseProtocolError},
+		{"invalid utf-8", rawFrame(true, byte(TextMessage), []byte{0xce, 0xba, 0xe1, 0xbd}), CloseInvalidPayload},
+		{"close code 1005", rawFrame(true, opClose, []byte{0x03, 0xed}), CloseProtocolError},
+		{"one byte close", rawFrame(true, opClose, []byte{0x03}), CloseProtocolError},
+		{"too big", rawFrame(true, byte(BinaryMessage), bytes.Repeat([]byte("x"), 100)), CloseMessageTooBig},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, done := echo(t, Options{MaxMessageSize: 64})
+			go client.rwc.Write(c.frame)
+			expectClose(t, client, c.code)
+			var ce *CloseError
+			require.ErrorAs(t, <-done, &ce)
+			assert.Equal(t, c.code, ce.Code)
+		})
+	}
+
+	// Test: a new message inside a fragmented one
+	client, done := echo(t, Options{})
+	go func() {
+		client.rwc.Write(rawFrame(false, byte(TextMessage), []byte("a")))
+		client.rwc.Write(rawFrame(true, byte(TextMessage), []byte("b")))
+	}()
+	expectClose(t, client, CloseProtocolError)
+	<-done
+}
+
+func TestUpgrade(t *testing.T) {
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		ws, err := Upgrade(w, req, Options{})
+		if err != nil {
+			return
+		}
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		ws.WriteMessage(messageType, data)
+		ws.Close(CloseNormal, "")
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	client := NewConn(conn, false, Options{})
+
+	// Test: a frame sent together with the handshake is not lost
+	var out bytes.Buffer
+	out.WriteString("GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	out.Write(rawFrame(true, byte(TextMessage), []byte("hello")))
+	_, err = conn.Write(out.Bytes())
+	require.NoError(t, err)
+
+	statusLine, err := client.br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	for {
+		line, err := client.br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	messageType, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "hello", string(data))
+
+	_, _, err = client.ReadMessage()
+	var ce *CloseError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, CloseNormal, ce.Code)
+}